@@ -0,0 +1,293 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"upspin.io/factotum"
+	"upspin.io/upspin"
+)
+
+const (
+	archiveManifest = "manifest.json"
+	archiveSig      = "manifest.sig"
+	archiveFiles    = "files/"
+)
+
+// ArchiveManifest describes the contents of a conversation archive bundle.
+type ArchiveManifest struct {
+	Title   string
+	Creator upspin.UserName
+	Created time.Time
+	// Access holds the conversation's Access file when it was archived.
+	Access string `json:",omitempty"`
+	// Keys holds the public keys of the conversation's participants and
+	// message authors when it was archived.
+	Keys  map[upspin.UserName]upspin.PublicKey
+	Files []ArchiveFile
+}
+
+// ArchiveFile records a file in an archive by its path relative to the
+// conversation directory.
+type ArchiveFile struct {
+	Path   string
+	Size   int64
+	SHA256 string
+}
+
+// Archive is a conversation read from an archive bundle.
+type Archive struct {
+	Manifest *ArchiveManifest
+	// Files holds the archived files' contents by relative path.
+	Files map[string][]byte
+	// manifest holds the manifest's bytes as signed.
+	manifest []byte
+	sig      upspin.Signature
+}
+
+// WriteArchive writes the conversation at convpath to w as a tar bundle
+// holding a manifest signed with c's key, the manifest's signature and every
+// conversation file (beneath "files/").  The keys of the conversation's
+// participants and message authors are looked up with keyFor.
+func WriteArchive(w io.Writer, cl upspin.Client, c upspin.Config, convpath upspin.PathName, keyFor func(upspin.UserName) (upspin.PublicKey, error)) error {
+	conv, err := ReadConversation(cl, convpath)
+	if err != nil {
+		return err
+	}
+	ents, err := recursiveList(cl, convpath)
+	if err != nil {
+		return fmt.Errorf("failed to list conversation files: %v", err)
+	}
+
+	man := &ArchiveManifest{
+		Title:   path.Base(string(convpath)),
+		Creator: c.UserName(),
+		Created: time.Now(),
+		Keys:    map[upspin.UserName]upspin.PublicKey{},
+	}
+	if data, err := cl.Get(Join(convpath, "Access")); err == nil {
+		man.Access = string(data)
+	}
+
+	users := append([]upspin.UserName{c.UserName()}, conv.Participants...)
+	for _, m := range append(append([]*Message{}, conv.Messages...), conv.Retractions...) {
+		users = append(users, m.Author)
+	}
+	for _, u := range users {
+		if _, ok := man.Keys[u]; ok {
+			continue
+		}
+		key, err := keyFor(u)
+		if err != nil {
+			return fmt.Errorf("failed to find public key for %v: %v", u, err)
+		}
+		man.Keys[u] = key
+	}
+
+	files := map[string][]byte{}
+	for _, ent := range ents {
+		data, err := cl.Get(ent.SignedName)
+		if err != nil {
+			return err
+		}
+		rel := strings.TrimPrefix(string(ent.SignedName), string(convpath)+"/")
+		files[rel] = data
+		man.Files = append(man.Files, ArchiveFile{Path: rel, Size: int64(len(data)), SHA256: fmt.Sprintf("%x", sha256.Sum256(data))})
+	}
+
+	manData, err := json.MarshalIndent(man, "", "    ")
+	if err != nil {
+		return err
+	}
+	h := sha256.Sum256(manData)
+	sig, err := c.Factotum().Sign(h[:])
+	if err != nil {
+		return fmt.Errorf("failed to sign manifest: %v", err)
+	}
+
+	tw := tar.NewWriter(w)
+	add := func(name string, data []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: man.Created}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	if err := add(archiveManifest, manData); err != nil {
+		return err
+	}
+	if err := add(archiveSig, []byte(fmt.Sprintf("%x\n%x\n", sig.R, sig.S))); err != nil {
+		return err
+	}
+	for _, f := range man.Files {
+		if err := add(archiveFiles+f.Path, files[f.Path]); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// ReadArchive reads an archive bundle written by WriteArchive.  It doesn't
+// verify the archive.
+func ReadArchive(r io.Reader) (*Archive, error) {
+	a := &Archive{Files: map[string][]byte{}}
+	var sigData []byte
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("malformed archive: %v", err)
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(tr, maxMsgSize*16))
+		if err != nil {
+			return nil, err
+		}
+
+		switch name := hdr.Name; {
+		case name == archiveManifest:
+			a.manifest = data
+		case name == archiveSig:
+			sigData = data
+		case strings.HasPrefix(name, archiveFiles):
+			rel := path.Clean(strings.TrimPrefix(name, archiveFiles))
+			if rel == "." || path.Base(rel) == "Access" || rel == ".." || strings.HasPrefix(rel, "../") || path.IsAbs(rel) {
+				return nil, fmt.Errorf("invalid archive file name %v", name)
+			}
+			a.Files[rel] = data
+		default:
+			return nil, fmt.Errorf("unexpected archive file %v", name)
+		}
+	}
+
+	if a.manifest == nil || sigData == nil {
+		return nil, errors.New("archive has no signed manifest")
+	}
+	a.Manifest = &ArchiveManifest{}
+	if err := json.Unmarshal(a.manifest, a.Manifest); err != nil {
+		return nil, fmt.Errorf("malformed archive manifest: %v", err)
+	} else if t := a.Manifest.Title; t == "" || t == "." || t == ".." || strings.Contains(t, "/") {
+		return nil, fmt.Errorf("invalid archived conversation title '%v'", t)
+	}
+	parts := strings.Fields(string(sigData))
+	if len(parts) != 2 {
+		return nil, errors.New("malformed archive signature")
+	}
+	var err error
+	if a.sig, err = parseSig(parts[0], parts[1]); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Verify checks the manifest's signature against the archive creator's key,
+// that the archived files match the manifest, and the signature of every
+// archived message against the keys recorded in the archive.  Problems with
+// the archive itself are returned as an error; the results of checking the
+// messages are returned as a report.
+func (a *Archive) Verify(creatorKey upspin.PublicKey) (*Report, error) {
+	h := sha256.Sum256(a.manifest)
+	if err := factotum.Verify(h[:], a.sig, creatorKey); err != nil {
+		return nil, fmt.Errorf("archive manifest not signed by %v: %v", a.Manifest.Creator, err)
+	}
+
+	if len(a.Files) != len(a.Manifest.Files) {
+		return nil, fmt.Errorf("archive holds %v files but its manifest lists %v", len(a.Files), len(a.Manifest.Files))
+	}
+	for _, f := range a.Manifest.Files {
+		data, ok := a.Files[f.Path]
+		if !ok {
+			return nil, fmt.Errorf("archive is missing %v", f.Path)
+		} else if fmt.Sprintf("%x", sha256.Sum256(data)) != f.SHA256 {
+			return nil, fmt.Errorf("archived %v differs from its manifest", f.Path)
+		}
+	}
+
+	report := &Report{Conversation: upspin.PathName(a.Manifest.Title)}
+	verify := TrustedKeys(a.Manifest.Keys).Verify
+	for _, rel := range a.paths() {
+		if !isMsgFile(upspin.PathName(rel)) || strings.Contains(rel, "/") {
+			continue
+		}
+		mr := VerifyPayload(rel, bytes.NewReader(a.Files[rel]), verify, a.Manifest.Created)
+		if mr.Name != MsgName(rel) && len(mr.Errors) == 0 {
+			mr.Errors = append(mr.Errors, fmt.Sprintf("file name differs from message name %v", mr.Name))
+		}
+		report.Messages = append(report.Messages, mr)
+	}
+	return report, nil
+}
+
+// Restore writes the archived files into the conversation directory named by
+// the archive's title beneath root.  The Access snapshot is restored only if
+// withAccess is true.
+func (a *Archive) Restore(cl upspin.Client, root upspin.PathName, withAccess bool) error {
+	dir := Join(root, a.Manifest.Title)
+	if err := MakeDirs(cl, dir); err != nil {
+		return err
+	}
+	if withAccess && a.Manifest.Access != "" {
+		if _, err := cl.Put(Join(dir, "Access"), []byte(a.Manifest.Access)); err != nil {
+			return fmt.Errorf("failed to restore Access file: %v", err)
+		}
+	}
+	for _, rel := range a.paths() {
+		p := Join(dir, rel)
+		if err := MakeDirs(cl, upspin.PathName(path.Dir(string(p)))); err != nil {
+			return err
+		}
+		if _, err := cl.Put(p, a.Files[rel]); err != nil {
+			return fmt.Errorf("failed to restore %v: %v", rel, err)
+		}
+	}
+	return nil
+}
+
+// RestoreLocal writes the archived files and Access snapshot into the
+// directory named by the archive's title beneath the local directory root.
+func (a *Archive) RestoreLocal(root string) error {
+	dir := filepath.Join(root, a.Manifest.Title)
+	files := map[string][]byte{}
+	for rel, data := range a.Files {
+		files[rel] = data
+	}
+	if a.Manifest.Access != "" {
+		files["Access"] = []byte(a.Manifest.Access)
+	}
+
+	for rel, data := range files {
+		fname := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(fname, data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// paths returns the relative paths of the archived files in order.
+func (a *Archive) paths() []string {
+	var paths []string
+	for rel := range a.Files {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+	return paths
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"upspin.io/upspin"
+)
+
+func TestArchive(t *testing.T) {
+	store := newMemClient()
+	alice := newTestConfig(t, "alice@example.com")
+	bob := newTestConfig(t, "bob@example.com")
+	convpath := ConvPath(alice.UserName(), "plans")
+
+	conv := NewConversation(DefaultRoot(alice.UserName()), "plans")
+	for _, c := range []*testConfig{alice, bob} {
+		m := conv.Add(c.UserName(), bytes.NewBufferString("hi from "+string(c.UserName())))
+		if err := m.send(store, c, DefaultRoot(alice.UserName())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.Put(Join(convpath, "notes.pdf"), []byte("%PDF")); err != nil {
+		t.Fatal(err)
+	}
+	access := "*: alice@example.com\nread,create,list: bob@example.com"
+	if _, err := store.Put(Join(convpath, "Access"), []byte(access)); err != nil {
+		t.Fatal(err)
+	}
+
+	pubkeys := map[upspin.UserName]upspin.PublicKey{alice.UserName(): alice.f.PublicKey(), bob.UserName(): bob.f.PublicKey()}
+	keyFor := func(u upspin.UserName) (upspin.PublicKey, error) {
+		if key, ok := pubkeys[u]; ok {
+			return key, nil
+		}
+		return "", fmt.Errorf("no key for %v", u)
+	}
+	var buf bytes.Buffer
+	if err := WriteArchive(&buf, store, alice, convpath, keyFor); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := ReadArchive(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Verify(bob.f.PublicKey()); err == nil {
+		t.Errorf("archive verified with the wrong creator key")
+	}
+	report, err := a.Verify(alice.f.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	} else if report.Failed() || len(report.Messages) != 2 {
+		t.Errorf("bad archive report: %+v", report.Messages)
+	}
+
+	// restore into bob's upspin tree and a local directory
+	if err := a.Restore(store, DefaultRoot(bob.UserName()), true); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := ReadConversation(store, ConvPath(bob.UserName(), "plans"))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(restored.Messages) != 2 {
+		t.Errorf("restored %v messages, want 2", len(restored.Messages))
+	}
+	if data, _ := store.Get(Join(ConvPath(bob.UserName(), "plans"), "Access")); string(data) != access {
+		t.Errorf("restored Access file %q", data)
+	}
+	dir := t.TempDir()
+	if err := a.RestoreLocal(dir); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "plans", "notes.pdf")); err != nil || string(data) != "%PDF" {
+		t.Errorf("local restore of attachment: %q, %v", data, err)
+	}
+
+	// tampering with a file is detected
+	var tampered bytes.Buffer
+	tr, tw := tar.NewReader(bytes.NewReader(buf.Bytes())), tar.NewWriter(&tampered)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		data, _ := ioutil.ReadAll(tr)
+		if hdr.Name == archiveFiles+"notes.pdf" {
+			data = []byte("%EXE")
+		}
+		tw.WriteHeader(hdr)
+		tw.Write(data)
+	}
+	tw.Close()
+	a, err = ReadArchive(&tampered)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := a.Verify(alice.f.PublicKey()); err == nil {
+		t.Errorf("tampered archive verified")
+	}
+}
+
+func TestArchiveFileNames(t *testing.T) {
+	for _, name := range []string{"..", "../x", "a/../../x", "/etc/passwd", "", "Access"} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		tw.WriteHeader(&tar.Header{Name: archiveFiles + name, Mode: 0600, Size: 1})
+		tw.Write([]byte("x"))
+		tw.Close()
+		if _, err := ReadArchive(&buf); err == nil {
+			t.Errorf("archive file name %q accepted", name)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"regexp"
+	"strings"
+
+	"upspin.io/upspin"
+)
+
+// Request is a message in a conversation that matched a bot handler.
+type Request struct {
+	Bot  *Bot
+	Conv *Conversation
+	Msg  *Message
+	// Args holds the whitespace separated arguments following a command, or
+	// the submatches of a pattern.
+	Args []string
+}
+
+// Reply adds a message with the given text to the request's conversation,
+// authored by the bot, and delivers it to the conversation's participants.
+func (r *Request) Reply(text string) error {
+	return r.Bot.Reply(r.Conv, text)
+}
+
+// Handler responds to a message matched by a bot.
+type Handler func(r *Request) error
+
+type botHandler struct {
+	command string
+	pattern *regexp.Regexp
+	h       Handler
+}
+
+// Bot is an automated conversation participant running as its own upspin
+// user.  It reads new messages delivered to the conversations under its root
+// and dispatches them to registered handlers.
+type Bot struct {
+	Config upspin.Config
+	Client upspin.Client
+	Root   upspin.PathName
+	// Verify, if non-nil, is used to check messages before they are handled.
+	// Messages that fail verification are ignored.
+	Verify func(*Message) error
+	// Seen records the messages already handled, per conversation.
+	Seen     map[upspin.PathName]map[MsgName]bool
+	handlers []botHandler
+}
+
+func NewBot(cfg upspin.Config, cl upspin.Client, root upspin.PathName) *Bot {
+	return &Bot{Config: cfg, Client: cl, Root: root, Seen: map[upspin.PathName]map[MsgName]bool{}}
+}
+
+// Command registers h to handle messages whose first word is "/" followed by
+// name.
+func (b *Bot) Command(name string, h Handler) {
+	b.handlers = append(b.handlers, botHandler{command: "/" + name, h: h})
+}
+
+// Handle registers h to handle messages whose content matches pattern.
+func (b *Bot) Handle(pattern *regexp.Regexp, h Handler) {
+	b.handlers = append(b.handlers, botHandler{pattern: pattern, h: h})
+}
+
+// MarkSeen records every message currently in the conversations under the
+// bot's root as seen, so that a bot starting without saved state doesn't
+// handle the conversations' history.
+func (b *Bot) MarkSeen() error {
+	if b.Seen == nil {
+		b.Seen = map[upspin.PathName]map[MsgName]bool{}
+	}
+
+	convs, err := ListConversations(b.Client, b.Root)
+	if err != nil {
+		return err
+	}
+	for _, convpath := range convs {
+		conv, err := ReadConversation(b.Client, convpath)
+		if err != nil {
+			return err
+		}
+		seen := b.Seen[convpath]
+		if seen == nil {
+			seen = map[MsgName]bool{}
+			b.Seen[convpath] = seen
+		}
+		for _, m := range conv.Messages {
+			seen[m.Name()] = true
+		}
+	}
+	return nil
+}
+
+// Poll dispatches every message not yet seen in the conversations under the
+// bot's root to matching handlers.  The bot's own messages are never
+// dispatched.  Handler failures are logged.
+func (b *Bot) Poll() error {
+	if b.Seen == nil {
+		b.Seen = map[upspin.PathName]map[MsgName]bool{}
+	}
+
+	convs, err := ListConversations(b.Client, b.Root)
+	if err != nil {
+		return err
+	}
+
+	for _, convpath := range convs {
+		conv, err := ReadConversation(b.Client, convpath)
+		if err != nil {
+			log.Printf("bot failed to read conversation %v: %v", convpath, err)
+			continue
+		}
+		seen := b.Seen[convpath]
+		if seen == nil {
+			seen = map[MsgName]bool{}
+			b.Seen[convpath] = seen
+		}
+
+		// handlers may append replies to conv.Messages
+		msgs := append([]*Message{}, conv.Messages...)
+		for _, m := range msgs {
+			if seen[m.Name()] {
+				continue
+			}
+			seen[m.Name()] = true
+			if m.Author == b.Config.UserName() {
+				continue
+			}
+			if b.Verify != nil {
+				if err := b.Verify(m); err != nil {
+					log.Printf("bot ignored unverified message %v in %v: %v", m.Name(), convpath, err)
+					continue
+				}
+			}
+			m.Decrypt(b.Config)
+			b.dispatch(conv, m)
+		}
+	}
+	return nil
+}
+
+func (b *Bot) dispatch(conv *Conversation, m *Message) {
+	content := strings.TrimSpace(m.Content())
+	for _, bh := range b.handlers {
+		r := &Request{Bot: b, Conv: conv, Msg: m}
+		if bh.command != "" {
+			fields := strings.Fields(content)
+			if len(fields) == 0 || fields[0] != bh.command {
+				continue
+			}
+			r.Args = fields[1:]
+		} else {
+			match := bh.pattern.FindStringSubmatch(content)
+			if match == nil {
+				continue
+			}
+			r.Args = match[1:]
+		}
+
+		if err := bh.h(r); err != nil {
+			log.Printf("bot handler failed on %v in '%v': %v", m.Name(), conv.Title(), err)
+		}
+	}
+}
+
+// Reply adds a message with the given text to conv authored by the bot and
+// delivers it as Conversation.Deliver does, so the bot's role and the
+// conversation's modes are respected.
+func (b *Bot) Reply(conv *Conversation, text string) error {
+	m := conv.Add(b.Config.UserName(), bytes.NewBufferString(text))
+	if b.Seen[conv.Location] != nil {
+		b.Seen[conv.Location][m.Name()] = true
+	}
+	return conv.Deliver(b.Client, b.Config, m)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"upspin.io/upspin"
+)
+
+func TestStandupBot(t *testing.T) {
+	const alice, botuser upspin.UserName = "alice@example.com", "standup-bot@example.com"
+	store := newMemClient()
+	alicecfg := newTestConfig(t, alice)
+
+	// alice posts her notes and asks for a report, delivering to the bot
+	conv := NewConversation(DefaultRoot(alice), "team")
+	for _, text := range []string{"/standup fixed the build", "/standup-report"} {
+		m := conv.Add(alice, bytes.NewBufferString(text))
+		for _, u := range []upspin.UserName{alice, botuser} {
+			if err := m.send(store, alicecfg, DefaultRoot(u)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	b := NewStandupBot(newTestConfig(t, botuser), store, DefaultRoot(botuser))
+	if err := b.Poll(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadConversation(store, ConvPath(alice, "team"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Messages) != 3 {
+		t.Fatalf("want 3 messages after bot reply, got %v:\n%v", len(got.Messages), got)
+	}
+	reply := got.Messages[2]
+	if reply.Author != botuser || !strings.Contains(reply.Content(), "**alice@example.com**: fixed the build") {
+		t.Errorf("bad bot reply:\n%v", reply)
+	}
+
+	// already handled messages don't trigger more replies
+	if err := b.Poll(); err != nil {
+		t.Fatal(err)
+	}
+	got, err = ReadConversation(store, ConvPath(botuser, "team"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Messages) != 3 {
+		t.Errorf("want 3 messages in bot's copy, got %v", len(got.Messages))
+	}
+}
+
+func TestBotMarkSeen(t *testing.T) {
+	const alice, botuser upspin.UserName = "alice@example.com", "standup-bot@example.com"
+	store := newMemClient()
+	alicecfg := newTestConfig(t, alice)
+
+	conv := NewConversation(DefaultRoot(botuser), "team")
+	post := func(text string) {
+		m := conv.Add(alice, bytes.NewBufferString(text))
+		if err := m.send(store, alicecfg, DefaultRoot(botuser)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	post("/standup-report")
+
+	b := NewStandupBot(newTestConfig(t, botuser), store, DefaultRoot(botuser))
+	if err := b.MarkSeen(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Poll(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadConversation(store, conv.Location)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(got.Messages) != 1 {
+		t.Fatalf("bot replied to history: %v", got)
+	}
+
+	post("/standup-report")
+	if err := b.Poll(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ReadConversation(store, conv.Location); len(got.Messages) != 3 {
+		t.Errorf("bot didn't reply to a new message: %v", got)
+	}
+}
+
+func TestBotAnnouncement(t *testing.T) {
+	const alice, botuser upspin.UserName = "alice@example.com", "standup-bot@example.com"
+	store := newMemClient()
+	alicecfg, botcfg := newTestConfig(t, alice), newTestConfig(t, botuser)
+	useKeys(t, TrustedKeys{alice: alicecfg.f.PublicKey(), botuser: botcfg.f.PublicKey()})
+
+	conv := NewConversation(DefaultRoot(botuser), "news")
+	m := conv.Add(alice, bytes.NewBufferString("/standup-report"))
+	if err := m.send(store, alicecfg, DefaultRoot(botuser)); err != nil {
+		t.Fatal(err)
+	}
+	md := NewMetadata(conv, alice)
+	if err := md.SetModes([]string{ModeAnnounceOnly}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteMetadata(store, alicecfg, "news", md, DefaultRoot(botuser)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the bot is only a reader, so its reply is refused
+	b := NewStandupBot(botcfg, store, DefaultRoot(botuser))
+	if err := b.Poll(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ReadConversation(store, conv.Location); len(got.Messages) != 1 {
+		t.Errorf("bot replied to an announcement: %v", got)
+	}
+}
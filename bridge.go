@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/smtp"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"upspin.io/upspin"
+)
+
+const bridgeIDDomain = "converse"
+
+var subjectToken = regexp.MustCompile(`\[converse ([0-9a-f]{8})\]`)
+
+// Mailer delivers outgoing email.
+type Mailer interface {
+	Send(from string, to []string, msg []byte) error
+}
+
+// Mailbox retrieves incoming email.  Fetch returns the email not yet marked
+// seen, and Seen marks fetched email once it has been handled so that later
+// fetches skip it.
+type Mailbox interface {
+	Fetch() ([]*Email, error)
+	Seen(emails []*Email) error
+}
+
+// SMTPMailer sends email through an SMTP server.
+type SMTPMailer struct {
+	Addr     string // host:port
+	Username string // no authentication if empty
+	Password string
+}
+
+func (s *SMTPMailer) Send(from string, to []string, msg []byte) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	return smtp.SendMail(s.Addr, auth, from, to, msg)
+}
+
+// IMAPMailbox fetches unseen messages from a mailbox on an IMAP server.
+type IMAPMailbox struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	Mailbox  string // defaults to INBOX
+	// Insecure disables TLS.
+	Insecure bool
+
+	uids map[*Email]string
+}
+
+// dial connects, logs in and selects the mailbox, returning the connection and
+// a function that logs out and closes it.
+func (b *IMAPMailbox) dial() (*imapConn, func(), error) {
+	var conn net.Conn
+	var err error
+	if b.Insecure {
+		conn, err = net.Dial("tcp", b.Addr)
+	} else {
+		conn, err = tls.Dial("tcp", b.Addr, nil)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := &imapConn{r: bufio.NewReader(conn), w: conn}
+	if greeting, _, err := c.readLine(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	} else if !strings.HasPrefix(greeting, "* OK") {
+		conn.Close()
+		return nil, nil, fmt.Errorf("unexpected imap greeting: %v", greeting)
+	}
+
+	mailbox := b.Mailbox
+	if mailbox == "" {
+		mailbox = "INBOX"
+	}
+	if _, err := c.cmd("LOGIN %v %v", imapQuote(b.Username), imapQuote(b.Password)); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	done := func() {
+		c.cmd("LOGOUT")
+		conn.Close()
+	}
+	if _, err := c.cmd("SELECT %v", imapQuote(mailbox)); err != nil {
+		done()
+		return nil, nil, err
+	}
+	return c, done, nil
+}
+
+func (b *IMAPMailbox) Fetch() ([]*Email, error) {
+	c, done, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	resps, err := c.cmd("UID SEARCH UNSEEN")
+	if err != nil {
+		return nil, err
+	}
+	var uids []string
+	for _, resp := range resps {
+		if strings.HasPrefix(resp.line, "* SEARCH") {
+			uids = append(uids, strings.Fields(resp.line)[2:]...)
+		}
+	}
+
+	var emails []*Email
+	b.uids = map[*Email]string{}
+	for _, uid := range uids {
+		resps, err := c.cmd("UID FETCH %v (BODY.PEEK[])", uid)
+		if err != nil {
+			return nil, err
+		}
+		for _, resp := range resps {
+			if resp.literal == nil {
+				continue
+			}
+			e, err := ParseEmail(bytes.NewReader(resp.literal))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse email uid %v: %v", uid, err)
+			}
+			emails = append(emails, e)
+			b.uids[e] = uid
+		}
+	}
+	return emails, nil
+}
+
+// Seen sets the \Seen flag on emails returned by the last Fetch.
+func (b *IMAPMailbox) Seen(emails []*Email) error {
+	if len(emails) == 0 {
+		return nil
+	}
+	c, done, err := b.dial()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	for _, e := range emails {
+		uid, ok := b.uids[e]
+		if !ok {
+			continue
+		}
+		if _, err := c.cmd(`UID STORE %v +FLAGS (\Seen)`, uid); err != nil {
+			return err
+		}
+		delete(b.uids, e)
+	}
+	return nil
+}
+
+type imapResp struct {
+	line    string
+	literal []byte
+}
+
+type imapConn struct {
+	r   *bufio.Reader
+	w   io.Writer
+	tag int
+}
+
+// cmd sends a tagged command and collects the untagged responses up to its
+// completion, returning an error unless it completes with OK.
+func (c *imapConn) cmd(format string, args ...interface{}) ([]imapResp, error) {
+	c.tag++
+	tag := fmt.Sprintf("a%03d", c.tag)
+	if _, err := fmt.Fprintf(c.w, "%v %v\r\n", tag, fmt.Sprintf(format, args...)); err != nil {
+		return nil, err
+	}
+
+	var resps []imapResp
+	for {
+		line, lit, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(line, tag+" ") {
+			if status := strings.Fields(line)[1]; status != "OK" {
+				return nil, fmt.Errorf("imap command failed: %v", line)
+			}
+			return resps, nil
+		}
+		resps = append(resps, imapResp{line: line, literal: lit})
+	}
+}
+
+// readLine reads one response line including a trailing literal if present.
+func (c *imapConn) readLine() (string, []byte, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasSuffix(line, "}") {
+		return line, nil, nil
+	}
+
+	i := strings.LastIndex(line, "{")
+	n, err := strconv.Atoi(line[i+1 : len(line)-1])
+	if err != nil {
+		return "", nil, fmt.Errorf("malformed imap literal: %v", line)
+	}
+	lit := make([]byte, n)
+	if _, err := io.ReadFull(c.r, lit); err != nil {
+		return "", nil, err
+	}
+	rest, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", nil, err
+	}
+	return line[:i] + strings.TrimRight(rest, "\r\n"), lit, nil
+}
+
+func imapQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+// Bridge relays messages between conversations and email.  New messages are
+// mailed out to email recipients, and email replies are added to the
+// conversation signed by the bridge user with the original sender recorded in
+// each message's Origin.  Conversations are identified in email by a token
+// in the subject and in Message-IDs.
+type Bridge struct {
+	Config upspin.Config
+	Client upspin.Client
+	Root   upspin.PathName
+	// Address is the bridge's own email address used as the sender of
+	// relayed messages.
+	Address string
+	// To holds the email recipients for relayed messages.
+	To      []string
+	Mailer  Mailer
+	Mailbox Mailbox
+	// Decrypt relays the decrypted content of encrypted messages.  Otherwise
+	// they're relayed with a placeholder, since email isn't end-to-end
+	// encrypted.
+	Decrypt bool
+	// Relayed records which messages have been mailed out, per conversation
+	// title.
+	Relayed map[string]map[MsgName]bool
+}
+
+// convToken returns the token identifying a conversation in email.
+func convToken(title string) string {
+	h := sha256.Sum256([]byte(title))
+	return fmt.Sprintf("%x", h[:4])
+}
+
+// emailMsgID returns the Message-ID of the email relaying message name.  The
+// '@' in the message's user name is replaced so that the ID has only one.
+func emailMsgID(title string, name MsgName) string {
+	local := strings.Replace(string(name), "@", "=", -1)
+	return fmt.Sprintf("<%v.%v@%v>", local, convToken(title), bridgeIDDomain)
+}
+
+// Run ingests email replies for the given conversations and then relays new
+// conversation messages out, including the replies just ingested.
+func (b *Bridge) Run(titles []string) error {
+	if err := b.Ingest(titles); err != nil {
+		return err
+	}
+	return b.Relay(titles)
+}
+
+// Relay mails out all messages in the given conversations that haven't been
+// relayed yet.  Messages that came in over email are not sent back to their
+// original sender.  The messages already in a conversation when it is first
+// relayed are recorded as relayed without mailing them.
+func (b *Bridge) Relay(titles []string) error {
+	if b.Relayed == nil {
+		b.Relayed = map[string]map[MsgName]bool{}
+	}
+
+	for _, title := range titles {
+		conv, err := ReadConversation(b.Client, Join(b.Root, title))
+		if err != nil {
+			return err
+		}
+		if b.Decrypt {
+			conv.Decrypt(b.Config)
+		}
+		relayed := b.Relayed[title]
+		if relayed == nil {
+			relayed = map[MsgName]bool{}
+			for _, m := range conv.Messages {
+				relayed[m.Name()] = true
+			}
+			b.Relayed[title] = relayed
+		}
+
+		for _, m := range conv.Messages {
+			if relayed[m.Name()] {
+				continue
+			}
+			var to []string
+			for _, addr := range b.To {
+				if m.Origin == nil || m.Origin.Source != emailSource || m.Origin.From != addr {
+					to = append(to, addr)
+				}
+			}
+			if len(to) > 0 {
+				if err := b.Mailer.Send(b.Address, to, b.compose(title, m, to)); err != nil {
+					return fmt.Errorf("failed to mail '%v' from '%v': %v", m.Name(), title, err)
+				}
+			}
+			relayed[m.Name()] = true
+		}
+	}
+	return nil
+}
+
+// compose formats m as an email to the given recipients.
+func (b *Bridge) compose(title string, m *Message, to []string) []byte {
+	subject := fmt.Sprintf("[converse %v] %v", convToken(title), title)
+	if m.Parent != "" {
+		subject = "Re: " + subject
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %v\r\n", b.Address)
+	fmt.Fprintf(&buf, "To: %v\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %v\r\n", m.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: %v\r\n", emailMsgID(title, m.Name()))
+	if m.Parent != "" {
+		parent := emailMsgID(title, m.Parent)
+		fmt.Fprintf(&buf, "In-Reply-To: %v\r\nReferences: %v\r\n", parent, parent)
+	}
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&buf, "%v wrote:\r\n\r\n", m.From())
+	buf.WriteString(strings.Replace(m.Content(), "\n", "\r\n", -1))
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// Ingest fetches new email and adds replies belonging to the given
+// conversations as messages signed by the bridge user, delivering them as
+// Conversation.Deliver does.  Email not belonging to any of the
+// conversations is ignored and left unseen, and email from senders not in
+// To is ignored and marked seen.  Other email is marked seen only once it
+// has been added to its conversation.
+func (b *Bridge) Ingest(titles []string) (err error) {
+	emails, err := b.Mailbox.Fetch()
+	if err != nil {
+		return fmt.Errorf("failed to fetch email: %v", err)
+	}
+	var handled []*Email
+	defer func() {
+		if err2 := b.Mailbox.Seen(handled); err2 != nil && err == nil {
+			err = fmt.Errorf("failed to mark email seen: %v", err2)
+		}
+	}()
+
+	tokens := map[string]string{}
+	for _, title := range titles {
+		tokens[convToken(title)] = title
+	}
+
+	for _, e := range emails {
+		if e.From == b.Address || !b.isRecipient(e.From) {
+			handled = append(handled, e)
+			continue
+		}
+		title, ok := tokens[emailToken(e)]
+		if !ok {
+			continue
+		}
+
+		conv, err := ReadConversation(b.Client, Join(b.Root, title))
+		if err != nil {
+			return err
+		}
+		m := conv.Add(b.Config.UserName(), bytes.NewBufferString(stripQuoted(e.Body)))
+		m.Origin = &Origin{Source: emailSource, From: e.From, MessageID: e.MessageID, InReplyTo: e.InReplyTo}
+
+		if err := conv.Deliver(b.Client, b.Config, m); err != nil {
+			return fmt.Errorf("failed to deliver reply from %v: %v", e.From, err)
+		}
+		handled = append(handled, e)
+	}
+	return nil
+}
+
+// isRecipient reports whether addr is one of the bridge's email recipients.
+func (b *Bridge) isRecipient(addr string) bool {
+	for _, to := range b.To {
+		if strings.EqualFold(to, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// emailToken returns the conversation token from an email's subject or the
+// Message-ID it replies to.
+func emailToken(e *Email) string {
+	if m := subjectToken.FindStringSubmatch(e.Subject); m != nil {
+		return m[1]
+	}
+	suffix := "@" + bridgeIDDomain + ">"
+	if !strings.HasSuffix(e.InReplyTo, suffix) {
+		return ""
+	}
+	id := strings.TrimSuffix(e.InReplyTo, suffix)
+	return id[strings.LastIndex(id, ".")+1:]
+}
+
+// stripQuoted removes the trailing quoted text (and its attribution line)
+// that mail clients append to replies.
+func stripQuoted(body string) string {
+	lines := strings.Split(body, "\n")
+	end := len(lines)
+	for end > 0 {
+		line := strings.TrimSpace(lines[end-1])
+		if line != "" && !strings.HasPrefix(line, ">") {
+			break
+		}
+		end--
+	}
+	if end < len(lines) && end > 0 && strings.HasSuffix(strings.TrimSpace(lines[end-1]), "wrote:") {
+		end--
+	}
+	return strings.TrimSpace(strings.Join(lines[:end], "\n"))
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"upspin.io/upspin"
+)
+
+// serve accepts connections on a local listener until the test ends and hands
+// each in turn to handler, returning the listener's address.
+func serve(t *testing.T, handler func(*textproto.Conn)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			tc := textproto.NewConn(conn)
+			handler(tc)
+			tc.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// sentMail records the email sent through it.
+type sentMail []string
+
+func (s *sentMail) Send(from string, to []string, msg []byte) error {
+	*s = append(*s, string(msg))
+	return nil
+}
+
+// inbox holds email for the bridge to fetch, recording which it marked seen.
+type inbox struct {
+	emails, seen []*Email
+}
+
+func (b *inbox) Fetch() ([]*Email, error) { return b.emails, nil }
+
+func (b *inbox) Seen(emails []*Email) error {
+	b.seen = append(b.seen, emails...)
+	return nil
+}
+
+func TestSMTPMailer(t *testing.T) {
+	received := make(chan string, 1)
+	addr := serve(t, func(c *textproto.Conn) {
+		c.PrintfLine("220 localhost ready")
+		for {
+			line, err := c.ReadLine()
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.Fields(line)[0]); cmd {
+			case "EHLO", "HELO", "MAIL", "RCPT":
+				c.PrintfLine("250 OK")
+			case "DATA":
+				c.PrintfLine("354 go ahead")
+				data, _ := c.ReadDotBytes()
+				received <- string(data)
+				c.PrintfLine("250 OK")
+			case "QUIT":
+				c.PrintfLine("221 bye")
+				return
+			default:
+				c.PrintfLine("502 unknown command %v", cmd)
+			}
+		}
+	})
+
+	m := &SMTPMailer{Addr: addr}
+	if err := m.Send("bridge@example.com", []string{"bob@example.com"}, []byte("Subject: hi\r\n\r\nhello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if data := <-received; !strings.Contains(data, "hello") {
+		t.Errorf("server received unexpected data: %q", data)
+	}
+}
+
+func TestIMAPMailbox(t *testing.T) {
+	const email = "From: bob@example.com\r\nSubject: Re: [converse 0badcafe] plans\r\n" +
+		"Date: Mon, 02 Jan 2017 10:00:00 +0000\r\nMessage-Id: <9@example.com>\r\n\r\nsounds good\r\n"
+
+	seen := make(chan bool, 1)
+	addr := serve(t, func(c *textproto.Conn) {
+		c.PrintfLine("* OK stand-in ready")
+		for {
+			line, err := c.ReadLine()
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			tag, cmd := fields[0], strings.ToUpper(strings.Join(fields[1:], " "))
+			switch {
+			case strings.HasPrefix(cmd, "UID SEARCH"):
+				c.PrintfLine("* SEARCH 7")
+			case strings.HasPrefix(cmd, "UID FETCH 7"):
+				c.PrintfLine("* 1 FETCH (UID 7 BODY[] {%v}", len(email))
+				fmt.Fprint(c.W, email)
+				c.PrintfLine(")")
+			case strings.HasPrefix(cmd, `UID STORE 7 +FLAGS (\SEEN)`):
+				seen <- true
+			case strings.HasPrefix(cmd, "LOGOUT"):
+				c.PrintfLine("* BYE")
+				c.PrintfLine("%v OK done", tag)
+				return
+			}
+			c.PrintfLine("%v OK done", tag)
+		}
+	})
+
+	b := &IMAPMailbox{Addr: addr, Username: "bridge", Password: "secret", Insecure: true}
+	emails, err := b.Fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 1 {
+		t.Fatalf("want 1 email, got %v", len(emails))
+	}
+	if e := emails[0]; e.Body != "sounds good" || emailToken(e) != "0badcafe" {
+		t.Errorf("fetched wrong email: %+v", e)
+	}
+	select {
+	case <-seen:
+		t.Fatal("email was marked seen before it was handled")
+	default:
+	}
+	if err := b.Seen(emails); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-seen:
+	default:
+		t.Error("handled email was not marked seen")
+	}
+}
+
+func TestBridgeThreading(t *testing.T) {
+	const title = "weekly plans"
+	b := &Bridge{Address: "bridge@example.com"}
+	m := NewMessage("alice@example.com", title, NewMsgName("bob@example.com", 1), bytes.NewBufferString("see you then"))
+
+	out, err := ParseEmail(bytes.NewReader(b.compose(title, m, []string{"carol@example.com"})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emailToken(out) != convToken(title) {
+		t.Errorf("outgoing subject %q lacks token %v", out.Subject, convToken(title))
+	}
+	if strings.Count(out.MessageID, "@") != 1 {
+		t.Errorf("invalid Message-ID %v", out.MessageID)
+	}
+
+	// a reply with a stripped subject is still threaded by its In-Reply-To
+	reply := &Email{Subject: "Re: plans", InReplyTo: out.MessageID}
+	if emailToken(reply) != convToken(title) {
+		t.Errorf("reply to %v not threaded into conversation", out.MessageID)
+	}
+}
+
+func TestBridgeRelay(t *testing.T) {
+	const alice upspin.UserName = "alice@example.com"
+	store := newMemClient()
+	cfg := newTestConfig(t, alice)
+	conv := NewConversation(DefaultRoot(alice), "plans")
+	send := func(text string) {
+		m := conv.Add(alice, bytes.NewBufferString(text))
+		if err := m.send(store, cfg, DefaultRoot(alice)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send("history")
+
+	var sent sentMail
+	b := &Bridge{Config: cfg, Client: store, Root: DefaultRoot(alice), Address: "bridge@example.com", To: []string{"bob@example.com"}, Mailer: &sent}
+	if err := b.Relay([]string{"plans"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 0 {
+		t.Fatalf("first relay mailed the history: %q", sent)
+	}
+
+	send("news")
+	if err := b.Relay([]string{"plans"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 || !strings.Contains(sent[0], "news") {
+		t.Errorf("relayed %q, want the new message", sent)
+	}
+
+	// Encrypted messages are relayed as a placeholder.
+	m := conv.Add(alice, bytes.NewBufferString("secret"))
+	if err := m.EncryptFor(map[upspin.UserName]upspin.PublicKey{alice: cfg.f.PublicKey()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.send(store, cfg, DefaultRoot(alice)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Relay([]string{"plans"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 2 || strings.Contains(sent[1], "secret") || !strings.Contains(sent[1], encryptedPlaceholder) {
+		t.Errorf("relayed %q, want the encrypted placeholder", sent[len(sent)-1])
+	}
+}
+
+func TestBridgeIngest(t *testing.T) {
+	const alice, bridge upspin.UserName = "alice@example.com", "bridge@example.com"
+	store := newMemClient()
+	alicecfg, bridgecfg := newTestConfig(t, alice), newTestConfig(t, bridge)
+	useKeys(t, TrustedKeys{alice: alicecfg.f.PublicKey(), bridge: bridgecfg.f.PublicKey()})
+
+	conv := NewConversation(DefaultRoot(bridge), "plans")
+	first := conv.Add(alice, bytes.NewBufferString("plans?"))
+	for _, u := range []upspin.UserName{alice, bridge} {
+		if err := first.send(store, alicecfg, DefaultRoot(u)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	subject := fmt.Sprintf("Re: [converse %v] plans", convToken("plans"))
+	mail := &inbox{emails: []*Email{
+		{From: "bob@example.com", Subject: subject, Body: "sounds good"},
+		{From: "mallory@example.com", Subject: subject, Body: "send money"},
+	}}
+	b := &Bridge{Config: bridgecfg, Client: store, Root: DefaultRoot(bridge), Address: "bridge@example.com", To: []string{"bob@example.com"}, Mailbox: mail}
+	if err := b.Ingest([]string{"plans"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(mail.seen) != 2 {
+		t.Errorf("marked %v emails seen, want 2", len(mail.seen))
+	}
+	got, err := ReadConversation(store, ConvPath(alice, "plans"))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(got.Messages) != 2 || got.Messages[1].Content() != "sounds good" {
+		t.Fatalf("alice's copy has %v, want only bob's reply added", got)
+	}
+
+	// the bridge may not post to announcements it doesn't own
+	md := NewMetadata(got, alice)
+	if err := md.SetModes([]string{ModeAnnounceOnly}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteMetadata(store, alicecfg, "plans", md, DefaultRoot(bridge)); err != nil {
+		t.Fatal(err)
+	}
+	mail.emails = []*Email{{From: "bob@example.com", Subject: subject, Body: "me too"}}
+	if err := b.Ingest([]string{"plans"}); err == nil {
+		t.Errorf("reply to an announcement ingested")
+	}
+}
+
+func TestStripQuoted(t *testing.T) {
+	body := "Works for me.\n\nOn Mon, Jan 2, 2017, bridge@example.com wrote:\n> see you then\n>\n"
+	if got := stripQuoted(body); got != "Works for me." {
+		t.Errorf("want %q, got %q", "Works for me.", got)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// canonicalMagic starts the signed bytes of version 4 and later messages.
+const canonicalMagic = "converse message\n"
+
+// canonical returns the bytes signed for version 4 and later messages.  They
+// don't depend on how the message file's JSON header is formatted, so any
+// implementation can reproduce them exactly.
+//
+// The bytes start with canonicalMagic, followed by a sequence of fields
+// each written as
+//
+//	<name> <length>:<value>\n
+//
+// where length is the decimal number of bytes in value.  The fields appear in
+// this order:
+//
+//	version                the decimal format version
+//	author                 the author's upspin user name
+//	time                   the message time in UTC as RFC 3339 with
+//	                       nanoseconds and no trailing zeros
+//	parent                 the parent message name, possibly empty
+//	title                  the conversation title
+//	origin.source          \
+//	origin.from             | only if the message has an Origin
+//	origin.message-id       |
+//	origin.in-reply-to     /
+//	encryption             the decimal number of wrapped keys, followed by
+//	                       the four key fields below for each key in order,
+//	                       only if the message is encrypted
+//	key.reader             \
+//	key.hash                | hex and base64 fields are written as they
+//	key.ephemeral           | appear in the header
+//	key.wrapped            /
+//	retracts               the retracted message name, possibly empty
+//	hides                  the hidden message name, possibly empty, only
+//	                       in version 5 and later
+//	original.version       \
+//	original.r              | only if the message was migrated
+//	original.s             /
+//	content                the (possibly encrypted) message content
+//
+// Messages are signed over the SHA-256 hash of these bytes.
+func (m *Message) canonical() []byte {
+	var buf bytes.Buffer
+	field := func(name, value string) { writeField(&buf, name, value) }
+
+	buf.WriteString(canonicalMagic)
+	field("version", strconv.Itoa(m.Version))
+	field("author", string(m.Author))
+	field("time", m.Time.UTC().Format(time.RFC3339Nano))
+	field("parent", string(m.Parent))
+	field("title", m.Title)
+	if o := m.Origin; o != nil {
+		field("origin.source", o.Source)
+		field("origin.from", o.From)
+		field("origin.message-id", o.MessageID)
+		field("origin.in-reply-to", o.InReplyTo)
+	}
+	if e := m.Encryption; e != nil {
+		field("encryption", strconv.Itoa(len(e.Keys)))
+		for _, wk := range e.Keys {
+			field("key.reader", string(wk.Reader))
+			field("key.hash", wk.KeyHash)
+			field("key.ephemeral", wk.Ephemeral)
+			field("key.wrapped", wk.Key)
+		}
+	}
+	field("retracts", string(m.Retracts))
+	if m.Version >= 5 {
+		field("hides", string(m.Hides))
+	}
+	if o := m.Original; o != nil {
+		field("original.version", strconv.Itoa(o.Version))
+		field("original.r", o.R)
+		field("original.s", o.S)
+	}
+	field("content", m.content)
+	return buf.Bytes()
+}
+
+// writeField writes a field of a canonical serialization.
+func writeField(buf *bytes.Buffer, name, value string) {
+	fmt.Fprintf(buf, "%v %v:%v\n", name, len(value), value)
+}
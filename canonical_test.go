@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"upspin.io/factotum"
+	"upspin.io/upspin"
+)
+
+// vectorKey is the public key for the private key whose D is the big-endian
+// integer of the bytes "converse canonical test vector!!".
+const vectorKey = upspin.PublicKey("p256\n87797595992893400246596013739607800837333152756226915662845762835007519984448\n42900203229880212363813744824591243303327579633950026530426579530147156201548\n")
+
+var canonicalVectors = []struct {
+	m         *Message
+	canonical string
+	hash      string
+}{
+	{
+		m: &Message{
+			Version: 4, Author: "alice@example.com",
+			Time:   time.Date(2017, 6, 1, 12, 30, 0, 500000000, time.FixedZone("", -4*3600)),
+			Parent: "msg1-bob@example.com.txt", Title: "plans", content: "meet at 3\n",
+		},
+		canonical: "converse message\nversion 1:4\nauthor 17:alice@example.com\ntime 22:2017-06-01T16:30:00.5Z\nparent 24:msg1-bob@example.com.txt\ntitle 5:plans\nretracts 0:\ncontent 10:meet at 3\n\n",
+		hash:      "f927d16fea56f77b7d4cee11415a1ea08b900f267635ba9a1f2b5c6a97615a86",
+	},
+	{
+		m: &Message{
+			Version: 4, Author: "bridge@example.com",
+			Time:   time.Date(2017, 6, 2, 8, 0, 0, 0, time.UTC),
+			Parent: "msg2-alice@example.com.txt", Title: "plans",
+			Origin: &Origin{Source: "email", From: "carol@example.org", MessageID: "<1@example.org>"},
+			Encryption: &Encryption{Keys: []WrappedKey{
+				{Reader: "alice@example.com", KeyHash: "ab", Ephemeral: "04cd", Key: "ZmFrZQ=="},
+			}},
+			content: "b3BhcXVl",
+		},
+		canonical: "converse message\nversion 1:4\nauthor 18:bridge@example.com\ntime 20:2017-06-02T08:00:00Z\nparent 26:msg2-alice@example.com.txt\ntitle 5:plans\norigin.source 5:email\norigin.from 17:carol@example.org\norigin.message-id 15:<1@example.org>\norigin.in-reply-to 0:\nencryption 1:1\nkey.reader 17:alice@example.com\nkey.hash 2:ab\nkey.ephemeral 4:04cd\nkey.wrapped 8:ZmFrZQ==\nretracts 0:\ncontent 8:b3BhcXVl\n",
+		hash:      "eef183507e479bc37dfe5b77f335c4e6a7fd0cb0269bfe113cd80071135ee72a",
+	},
+	{
+		m: &Message{
+			Version: 5, Author: "bob@example.com",
+			Time:   time.Date(2017, 6, 3, 9, 15, 0, 0, time.UTC),
+			Parent: "msg3-alice@example.com.txt", Title: "plans",
+			Hides: "msg2-carol@example.com.txt", content: "hid msg2-carol@example.com.txt",
+		},
+		canonical: "converse message\nversion 1:5\nauthor 15:bob@example.com\ntime 20:2017-06-03T09:15:00Z\nparent 26:msg3-alice@example.com.txt\ntitle 5:plans\nretracts 0:\nhides 26:msg2-carol@example.com.txt\ncontent 30:hid msg2-carol@example.com.txt\n",
+		hash:      "1d5805928bf60c1dcc4c882385d5bbd9f06ff32f7a5ed0dfb3fdf3949e830b2e",
+	},
+}
+
+func TestCanonicalVectors(t *testing.T) {
+	for i, v := range canonicalVectors {
+		if got := string(v.m.canonical()); got != v.canonical {
+			t.Errorf("vector %v: canonical bytes\n%q\nwant\n%q", i, got, v.canonical)
+		}
+		if got := fmt.Sprintf("%x", sha256.Sum256([]byte(v.canonical))); got != v.hash {
+			t.Errorf("vector %v: hash %v, want %v", i, got, v.hash)
+		}
+		if got := fmt.Sprintf("%x", v.m.contentHash()); got != v.hash {
+			t.Errorf("vector %v: content hash %v, want %v", i, got, v.hash)
+		}
+	}
+}
+
+// TestCanonicalFile checks that a message file signed over the first vector
+// verifies however its JSON header is formatted.
+func TestCanonicalFile(t *testing.T) {
+	const (
+		r = "6992bff8373f6e7bcf219aa0f5dee2844031f30525592c76768b5de8e58b4db8"
+		s = "2068161fb60c08f9a8fcba03cc83be471010bfdddfc2bc73515a0a07082a0c70"
+	)
+	headers := []string{
+		`{"Title":"plans","ParentMessage":"msg1-bob@example.com.txt","Time":"2017-06-01T12:30:00.5-04:00","Author":"alice@example.com","Length":10,"Version":4}`,
+		"{\n  \"Version\": 4,\n  \"Author\": \"alice@example.com\",\n  \"Time\": \"2017-06-01T16:30:00.500Z\",\n  \"ParentMessage\": \"msg1-bob@example.com.txt\",\n  \"Title\": \"plans\",\n  \"Length\": 10\n}",
+	}
+	for i, header := range headers {
+		file := header + "\n" + msgHeaderMarker + "meet at 3\n" + msgSigHeader + "\n" + r + "\n" + s + "\n"
+		m, err := ParseMessage(strings.NewReader(file))
+		if err != nil {
+			t.Fatalf("header %v: %v", i, err)
+		}
+		if got := string(m.canonical()); got != canonicalVectors[0].canonical {
+			t.Errorf("header %v: canonical bytes\n%q", i, got)
+		}
+		if err := m.verifyKey(vectorKey); err != nil {
+			t.Errorf("header %v: %v", i, err)
+		}
+	}
+
+	hash := canonicalVectors[0].m.contentHash()
+	sig, err := parseSig(r, s)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := factotum.Verify(hash, sig, vectorKey); err != nil {
+		t.Errorf("vector signature doesn't verify: %v", err)
+	}
+}
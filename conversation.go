@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"html/template"
 	"io"
+	"path"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/russross/blackfriday"
@@ -44,12 +47,24 @@ func ListConversations(cl upspin.Client, root upspin.PathName) ([]upspin.PathNam
 }
 
 type Conversation struct {
-	Messages     []*Message
+	Messages []*Message
+	// Retractions holds the messages retracting or hiding earlier
+	// messages.  They are kept out of Messages.
+	Retractions  []*Message
 	Participants []upspin.UserName
 	Location     upspin.PathName
-	title        string
+	// Name is the conversation's display name if it has been renamed and
+	// Metadata is its current metadata, if any (see LoadMetadata).
+	Name     string
+	Metadata *Metadata
+	title    string
 }
 
+// ConversationKeys, if non-nil, looks up the keys that ReadConversation
+// verifies retractions and conversation metadata with.  Retractions that
+// don't verify are ignored, as are all retractions if it is nil.
+var ConversationKeys func(upspin.UserName) (upspin.PublicKey, error)
+
 func NewConversation(root upspin.PathName, title string) *Conversation {
 	return &Conversation{title: title, Location: Join(root, title)}
 }
@@ -66,18 +81,30 @@ func ReadConversation(cl upspin.Client, dir upspin.PathName) (*Conversation, err
 	}
 
 	for _, ent := range ents {
+		if !isMsgFile(ent.SignedName) {
+			continue
+		}
 		m, err := ReadMessage(cl, ent.SignedName)
 		if err != nil {
 			return nil, fmt.Errorf("failed to open message '%v': %v", ent.SignedName, err)
 		}
-		conv.Messages = append(conv.Messages, m)
+		if m.Retracts != "" || m.Hides != "" {
+			conv.Retractions = append(conv.Retractions, m)
+		} else {
+			conv.Messages = append(conv.Messages, m)
+		}
+	}
+	if err := conv.readPruned(cl); err != nil {
+		return nil, err
+	}
+	conv.applyRetractions()
+	if ConversationKeys != nil {
+		if _, err := conv.LoadMetadata(cl, ConversationKeys); err != nil {
+			return nil, err
+		}
+	} else {
+		conv.applyRoles()
 	}
-
-	sort.Slice(conv.Messages, func(i, j int) bool {
-		mi, mj := conv.Messages[i], conv.Messages[j]
-		ni, nj := mi.Name().Number(), mj.Name().Number()
-		return (ni != nj && ni < nj) || (mi.Time.Unix() < mj.Time.Unix())
-	})
 
 	ac, err := readAccess(cl, dir)
 	if err != nil {
@@ -96,6 +123,198 @@ func ReadConversation(cl upspin.Client, dir upspin.PathName) (*Conversation, err
 	return conv, nil
 }
 
+// authentic reports whether m, read from a conversation, is stored under its
+// own name and verifies against its author's key from ConversationKeys.
+func authentic(m *Message) bool {
+	if ConversationKeys == nil || MsgName(path.Base(string(m.File()))) != m.Name() {
+		return false
+	}
+	key, err := ConversationKeys(m.Author)
+	return err == nil && m.verifyKey(key) == nil
+}
+
+// applyRetractions marks the messages retracted by their authors, adding
+// placeholders for retracted messages that have been removed, and sorts the
+// messages.
+func (c *Conversation) applyRetractions() {
+	have := map[MsgName]*Message{}
+	for _, m := range c.Messages {
+		have[m.Name()] = m
+	}
+	for _, r := range c.Retractions {
+		if r.Retracts == "" || r.Retracts.User() != r.Author || !authentic(r) {
+			continue // only authors may retract their messages
+		}
+		if m := have[r.Retracts]; m != nil {
+			m.retracted = true
+			continue
+		}
+		var parent MsgName
+		if n := r.Retracts.Number(); n > 1 {
+			parent = NewMsgName(r.Author, n-1)
+		}
+		m := &Message{Author: r.Author, Title: r.Title, Time: r.Time, Parent: parent, retracted: true}
+		have[m.Name()] = m
+		c.Messages = append(c.Messages, m)
+	}
+
+	sort.Slice(c.Messages, func(i, j int) bool {
+		mi, mj := c.Messages[i], c.Messages[j]
+		ni, nj := mi.Name().Number(), mj.Name().Number()
+		return (ni != nj && ni < nj) || (mi.Time.Unix() < mj.Time.Unix())
+	})
+}
+
+// Retract adds a message by user retracting the user's message named target
+// and marks the target as retracted.  The returned retraction must be sent to
+// the participants.
+func (c *Conversation) Retract(user upspin.UserName, target MsgName) (*Message, error) {
+	if target.User() != user {
+		return nil, fmt.Errorf("cannot retract %v's message %v", target.User(), target)
+	}
+	var retracted *Message
+	for _, m := range c.Messages {
+		if m.Name() == target {
+			retracted = m
+		}
+	}
+	if retracted == nil {
+		return nil, fmt.Errorf("no message %v in '%v'", target, c.Title())
+	}
+
+	m := NewMessage(user, c.Title(), c.nextParent(), bytes.NewBufferString(fmt.Sprintf("retracted %v", target)))
+	m.Retracts = target
+	c.Retractions = append(c.Retractions, m)
+	retracted.retracted = true
+	return m, nil
+}
+
+// applyRoles marks the messages hidden by moderators and those whose author's
+// current role doesn't permit posting according to the conversation's
+// metadata, whenever they were posted: message times are chosen by their
+// authors.  Hides that aren't authentic, predate version 5 or are by
+// participants who aren't moderators or owners are ignored.
+func (c *Conversation) applyRoles() {
+	have := map[MsgName]*Message{}
+	for _, m := range c.Messages {
+		m.hidden = false
+		m.rejected = m.File() != "" && !c.CanPost(m.Author)
+		have[m.Name()] = m
+	}
+	for _, h := range c.Retractions {
+		if m := have[h.Hides]; m != nil && h.FormatVersion() >= 5 && c.CanModerate(h.Author) && authentic(h) {
+			m.hidden = true
+		}
+	}
+}
+
+// Hide adds a message by user, who must be a moderator or owner, hiding the
+// message named target, and marks the target as hidden.  The message is
+// returned so that it can be sent.
+func (c *Conversation) Hide(user upspin.UserName, target MsgName) (*Message, error) {
+	if !c.CanModerate(user) {
+		return nil, fmt.Errorf("%v is not a moderator of '%v'", user, c.DisplayName())
+	}
+	var hidden *Message
+	for _, m := range c.Messages {
+		if m.Name() == target {
+			hidden = m
+		}
+	}
+	if hidden == nil {
+		return nil, fmt.Errorf("no message %v in '%v'", target, c.Title())
+	}
+
+	m := NewMessage(user, c.Title(), c.nextParent(), bytes.NewBufferString(fmt.Sprintf("hid %v", target)))
+	m.Hides = target
+	c.Retractions = append(c.Retractions, m)
+	hidden.hidden = true
+	return m, nil
+}
+
+// CheckPosts returns an error if any of msgs may not be posted to the
+// conversation by its author: hides need a moderator or owner and other
+// messages an author who may post.
+func (c *Conversation) CheckPosts(msgs ...*Message) error {
+	for _, m := range msgs {
+		if m.Hides != "" {
+			if !c.CanModerate(m.Author) {
+				return fmt.Errorf("%v is not a moderator of '%v'", m.Author, c.DisplayName())
+			}
+		} else if !c.CanPost(m.Author) {
+			return fmt.Errorf("%v may not post to '%v' as a %v", m.Author, c.DisplayName(), c.RoleOf(m.Author))
+		}
+	}
+	return nil
+}
+
+// Deliver checks msgs with CheckPosts and writes them with cl to our copy of
+// the conversation and the participants' copies it is pushed to (see
+// participantRoots), signing unsigned messages with cfg.  Delivery continues
+// past failures and the first one is returned.
+func (c *Conversation) Deliver(cl upspin.Client, cfg upspin.Config, msgs ...*Message) error {
+	if err := c.CheckPosts(msgs...); err != nil {
+		return err
+	}
+	var first error
+	for _, root := range participantRoots(c, c.Metadata) {
+		for _, m := range msgs {
+			if err := m.send(cl, cfg, root); err != nil && first == nil {
+				first = fmt.Errorf("send of %v to %v failed: %v", m.Name(), root, err)
+			}
+		}
+	}
+	return first
+}
+
+// participantRoots returns the conversation roots to write new messages and
+// metadata to: the root of our copy first, followed by the other
+// participants' unless the conversation is pull-only.  Subscribers to an
+// announcement pull new posts so only its owners' roots are included.
+func participantRoots(conv *Conversation, md *Metadata) []upspin.PathName {
+	self := upspin.UserName(strings.SplitN(string(conv.Location), "/", 2)[0])
+	roots := []upspin.PathName{upspin.PathName(path.Dir(string(conv.Location)))}
+	if md != nil && md.HasMode(ModePullOnly) {
+		return roots
+	}
+	for _, u := range conv.Participants {
+		if u == self || md != nil && md.HasMode(ModeAnnounceOnly) && !md.IsOwner(u) {
+			continue
+		}
+		roots = append(roots, DefaultRoot(u))
+	}
+	return roots
+}
+
+// Migrate rewrites the conversation's messages authored by cfg's user that
+// use an older format version in the current version, recording their
+// original signatures.  Other authors' messages are left untouched since only
+// their authors can re-sign them; they are returned in kept.
+func (c *Conversation) Migrate(cl upspin.Client, cfg upspin.Config) (migrated, kept []MsgName, err error) {
+	for _, m := range append(append([]*Message{}, c.Messages...), c.Retractions...) {
+		if m.File() == "" || m.FormatVersion() >= msgVersion {
+			continue
+		} else if m.Author != cfg.UserName() {
+			kept = append(kept, m.Name())
+			continue
+		}
+
+		m2, err := m.Migrate(cfg)
+		if err != nil {
+			return migrated, kept, err
+		}
+		payload, err := m2.Payload()
+		if err != nil {
+			return migrated, kept, err
+		}
+		if _, err := cl.Put(m.File(), []byte(payload)); err != nil {
+			return migrated, kept, fmt.Errorf("failed to rewrite %v: %v", m.File(), err)
+		}
+		migrated = append(migrated, m.Name())
+	}
+	return migrated, kept, nil
+}
+
 func (c *Conversation) SetTitle(title string) error {
 	if c.Title() != "" {
 		return errors.New("cannot set title on a titled conversation")
@@ -121,11 +340,58 @@ func (c *Conversation) RenderHtml() []byte {
 	var buf bytes.Buffer
 	for i, m := range c.Messages {
 		fmt.Fprintf(&buf, "\n------------ *%v on %v (msg %v)* ------------\n\n%v\n",
-			m.Author, m.Time.Format(time.UnixDate), i+1, m.Content())
+			m.From(), m.Time.Format(time.UnixDate), i+1, m.Content())
 	}
 	return blackfriday.MarkdownCommon(buf.Bytes())
 }
 
+// RenderTemplate renders the conversation as html using t.  The template is
+// executed with the conversation's Title (its display name) and its
+// Messages, each of which has a Num, From, Time and markdown rendered HTML
+// field.
+func (c *Conversation) RenderTemplate(t *template.Template) ([]byte, error) {
+	type msg struct {
+		Num  int
+		From string
+		Time time.Time
+		HTML template.HTML
+	}
+	data := struct {
+		Title    string
+		Messages []msg
+	}{Title: c.DisplayName()}
+	for i, m := range c.Messages {
+		html := blackfriday.MarkdownCommon([]byte(m.Content()))
+		data.Messages = append(data.Messages, msg{i + 1, m.From(), m.Time, template.HTML(html)})
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Html renders the conversation using t or, if t is nil, RenderHtml.
+func (c *Conversation) Html(t *template.Template) ([]byte, error) {
+	if t == nil {
+		return c.RenderHtml(), nil
+	}
+	return c.RenderTemplate(t)
+}
+
+// DisplayName returns the conversation's current name: its Name if it has
+// been renamed and otherwise its title.
+func (c *Conversation) DisplayName() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.Title()
+}
+
+// Title returns the conversation's title, which names its directory and is
+// signed into every message.  It never changes, even when the conversation is
+// renamed.
 func (c *Conversation) Title() string {
 	if len(c.Messages) == 0 {
 		return c.title
@@ -152,10 +418,13 @@ func (c *Conversation) Add(user upspin.UserName, body io.Reader) *Message {
 }
 
 func (c *Conversation) nextParent() MsgName {
-	if len(c.Messages) == 0 {
-		return MsgName("")
+	var last MsgName
+	for _, m := range append(append([]*Message{}, c.Messages...), c.Retractions...) {
+		if last == "" || m.Name().Number() >= last.Number() {
+			last = m.Name()
+		}
 	}
-	return c.Messages[len(c.Messages)-1].Name()
+	return last
 }
 
 func (c *Conversation) hasAccess(cl upspin.Client, u upspin.UserName) bool {
@@ -185,7 +454,130 @@ func (c *Conversation) AddParticipant(cfg upspin.Config, u upspin.UserName) erro
 	if c.hasAccess(cl, u) {
 		return nil
 	}
+	return c.grant(cl, cfg.UserName(), string(u), c.rights(u))
+}
+
+// SetRights replaces u's rights in the conversation's Access file with those
+// of u's current role.  Only our copy's Access file is changed.
+func (c *Conversation) SetRights(cfg upspin.Config, u upspin.UserName) error {
+	if u == cfg.UserName() {
+		return nil // we own our copy
+	}
+	cl := client.New(cfg)
+	data, err := cl.Get(Join(c.Location, "Access"))
+	if err != nil {
+		return c.grant(cl, cfg.UserName(), string(u), c.rights(u))
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			lines = append(lines, line)
+			continue
+		}
+		var who []string
+		for _, w := range splitList(line[i+1:]) {
+			if w != string(u) {
+				who = append(who, w)
+			}
+		}
+		if len(who) > 0 {
+			lines = append(lines, fmt.Sprintf("%v: %v", strings.TrimSpace(line[:i]), strings.Join(who, ", ")))
+		}
+	}
+	lines = append(lines, fmt.Sprintf("%v: %v", c.rights(u), u))
+	_, err = cl.Put(Join(c.Location, "Access"), []byte(strings.Join(lines, "\n")))
+	return err
+}
+
+// RefreshRights rewrites the rights of every user and group granted access by
+// our copy's Access file to those of their current role, as needed after the
+// conversation's modes or owners change.
+func (c *Conversation) RefreshRights(cfg upspin.Config) error {
+	return c.refreshRights(client.New(cfg), cfg.UserName())
+}
+
+func (c *Conversation) refreshRights(cl upspin.Client, owner upspin.UserName) error {
+	data, err := cl.Get(Join(c.Location, "Access"))
+	if err != nil {
+		return nil // nobody else has been granted access
+	}
+
+	var lines, whos []string
+	for _, line := range strings.Split(string(data), "\n") {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			lines = append(lines, line)
+			continue
+		}
+		var kept []string
+		for _, w := range splitList(line[i+1:]) {
+			if upspin.UserName(w) == owner {
+				kept = append(kept, w)
+			} else if !contains(whos, w) {
+				whos = append(whos, w)
+			}
+		}
+		if len(kept) > 0 {
+			lines = append(lines, fmt.Sprintf("%v: %v", strings.TrimSpace(line[:i]), strings.Join(kept, ", ")))
+		}
+	}
+	for _, w := range whos {
+		rights := c.groupRights()
+		if !strings.Contains(w, "/") {
+			rights = c.rights(upspin.UserName(w))
+		}
+		lines = append(lines, fmt.Sprintf("%v: %v", rights, w))
+	}
+	_, err = cl.Put(Join(c.Location, "Access"), []byte(strings.Join(lines, "\n")))
+	return err
+}
+
+// groupRights returns the Access rights granted to groups of participants.
+func (c *Conversation) groupRights() string {
+	if c.IsAnnouncement() {
+		return roleRights[RoleReader]
+	}
+	return roleRights[RoleMember]
+}
+
+// rights returns the Access rights for u's role.
+func (c *Conversation) rights(u upspin.UserName) string {
+	role := c.RoleOf(u)
+	if c.IsAnnouncement() && role != RoleOwner {
+		role = RoleReader
+	}
+	return roleRights[role]
+}
+
+// AddGroup adds the members of the upspin Group file at group to the
+// conversation's participants.  The group itself (rather than its current
+// members) is granted access in the conversation's Access file so that later
+// membership changes propagate.
+func (c *Conversation) AddGroup(cfg upspin.Config, group upspin.PathName) error {
+	cl := client.New(cfg)
+	members, err := groupMembers(cl, c.Location, group)
+	if err != nil {
+		return fmt.Errorf("failed to read group %v: %v", group, err)
+	}
+	for _, u := range members {
+		if !c.isParticipant(u) {
+			c.Participants = append(c.Participants, u)
+		}
+	}
+
+	data, err := cl.Get(Join(c.Location, "Access"))
+	if err == nil && accessMentions(data, string(group)) {
+		return nil
+	}
+	return c.grant(cl, cfg.UserName(), string(group), c.groupRights())
+}
 
+// grant appends a rule giving who (a user or group) the comma-separated
+// rights to the conversation's Access file, creating the file with owner
+// holding all rights if necessary.
+func (c *Conversation) grant(cl upspin.Client, owner upspin.UserName, who, rights string) error {
 	pth := Join(c.Location, "Access")
 
 	var data []byte
@@ -193,7 +585,7 @@ func (c *Conversation) AddParticipant(cfg upspin.Config, u upspin.UserName) erro
 	_, err := cl.Lookup(pth, false)
 	if err != nil {
 		// create access file
-		data = []byte(fmt.Sprintf("*: %v", cfg.UserName()))
+		data = []byte(fmt.Sprintf("*: %v", owner))
 	} else {
 		data, err = cl.Get(pth)
 		if err != nil {
@@ -201,7 +593,7 @@ func (c *Conversation) AddParticipant(cfg upspin.Config, u upspin.UserName) erro
 		}
 	}
 
-	data = append(data, []byte(fmt.Sprintf("\nread,create,list: %v", u))...)
+	data = append(data, []byte(fmt.Sprintf("\n%v: %v", rights, who))...)
 
 	_, err = cl.Put(pth, data)
 	if err != nil {
@@ -211,15 +603,50 @@ func (c *Conversation) AddParticipant(cfg upspin.Config, u upspin.UserName) erro
 	return nil
 }
 
-func (c *Conversation) Publish(cl upspin.Client) error {
+// Decrypt decrypts all encrypted messages readable by cfg's user.  Messages
+// that can't be decrypted are left encrypted.
+func (c *Conversation) Decrypt(cfg upspin.Config) {
+	for _, m := range c.Messages {
+		m.Decrypt(cfg)
+	}
+}
+
+// Publish renders the conversation as html (using t if non-nil) into an
+// 'index.html' file in its directory, along with an Atom feed if it is an
+// announcement.  Encrypted messages are published without their decrypted
+// content.
+func (c *Conversation) Publish(cl upspin.Client, t *template.Template) error {
 	if len(c.Messages) == 0 {
 		return errors.New("cannot publish a conversation without no messages")
 	}
 
+	// never publish decrypted content
+	sealed := *c
+	sealed.Messages = nil
+	for _, m := range c.Messages {
+		sealed.Messages = append(sealed.Messages, m.sealed())
+	}
+
+	html, err := sealed.Html(t)
+	if err != nil {
+		return fmt.Errorf("failed to render conversation: %v", err)
+	}
+
 	pth := Join(c.Location, "index.html")
-	_, err := cl.Put(pth, c.RenderHtml())
+	_, err = cl.Put(pth, html)
 	if err != nil {
 		return fmt.Errorf("failed to create published 'index.html' file: %v", err)
 	}
+
+	if !c.IsAnnouncement() {
+		return nil
+	}
+	feed, err := sealed.Feed()
+	if err != nil {
+		return fmt.Errorf("failed to render feed: %v", err)
+	}
+	if _, err := cl.Put(Join(c.Location, feedFile), feed); err != nil {
+		return fmt.Errorf("failed to create published '%v' file: %v", feedFile, err)
+	}
 	return nil
 }
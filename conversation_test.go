@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRetract(t *testing.T) {
+	store := newMemClient()
+	alice := newTestConfig(t, "alice@example.com")
+	bob := newTestConfig(t, "bob@example.com")
+	convpath := ConvPath(alice.UserName(), "plans")
+	useKeys(t, TrustedKeys{alice.UserName(): alice.f.PublicKey(), bob.UserName(): bob.f.PublicKey()})
+
+	conv := NewConversation(DefaultRoot(alice.UserName()), "plans")
+	m1 := conv.Add(alice.UserName(), bytes.NewBufferString("wrong room"))
+	m2 := conv.Add(alice.UserName(), bytes.NewBufferString("meet at 3"))
+	for _, m := range []*Message{m1, m2} {
+		if err := m.send(store, alice, DefaultRoot(alice.UserName())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a retraction "by" alice signed by bob is ignored
+	forged := NewMessage(bob.UserName(), "plans", m2.Name(), bytes.NewBufferString("retracted"))
+	forged.Retracts = m2.Name()
+	if _, err := forged.Sign(bob); err != nil {
+		t.Fatal(err)
+	}
+	forged.Author = alice.UserName()
+	if err := forged.send(store, bob, DefaultRoot(alice.UserName())); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ReadConversation(store, convpath); err != nil {
+		t.Fatal(err)
+	} else if got.Messages[1].IsRetracted() {
+		t.Errorf("forged retraction applied")
+	}
+	if err := store.Delete(Join(convpath, string(forged.Name()))); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conv.Retract(bob.UserName(), m1.Name()); err == nil {
+		t.Errorf("bob retracted alice's message")
+	}
+	r, err := conv.Retract(alice.UserName(), m1.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.send(store, alice, DefaultRoot(alice.UserName())); err != nil {
+		t.Fatal(err)
+	}
+	if r.Name() != m2.Name().NextName(alice.UserName()) {
+		t.Errorf("retraction named %v, want %v", r.Name(), m2.Name().NextName(alice.UserName()))
+	}
+
+	check := func(when string) {
+		conv, err := ReadConversation(store, convpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(conv.Messages) != 2 || len(conv.Retractions) != 1 {
+			t.Fatalf("%v: got %v messages and %v retractions", when, len(conv.Messages), len(conv.Retractions))
+		}
+		if got := conv.Messages[0]; got.Name() != m1.Name() || got.Content() != retractedPlaceholder {
+			t.Errorf("%v: first message is %v with content %q", when, got.Name(), got.Content())
+		}
+		if s := conv.String(); strings.Contains(s, "wrong room") || !strings.Contains(s, "meet at 3") {
+			t.Errorf("%v: bad rendering:\n%v", when, s)
+		}
+		if next := conv.nextParent(); next != r.Name() {
+			t.Errorf("%v: next parent is %v, want %v", when, next, r.Name())
+		}
+	}
+	check("retracted")
+
+	if err := Remove(store, alice, convpath, string(m1.Name())); err != nil {
+		t.Fatal(err)
+	}
+	check("removed")
+}
+
+func TestMigrate(t *testing.T) {
+	store := newMemClient()
+	alice := newTestConfig(t, "alice@example.com")
+	bob := newTestConfig(t, "bob@example.com")
+	convpath := ConvPath(alice.UserName(), "plans")
+
+	// version 1 messages have no Version header field
+	legacy := func(c *testConfig, parent MsgName) *Message {
+		m := NewMessage(c.UserName(), "plans", parent, bytes.NewBufferString("hi from "+string(c.UserName())))
+		m.Version = 0
+		if err := m.send(store, c, DefaultRoot(alice.UserName())); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	m1 := legacy(alice, "")
+	m2 := legacy(bob, m1.Name())
+	if data, _ := store.Get(Join(convpath, string(m1.Name()))); bytes.Contains(data, []byte("Version")) {
+		t.Fatalf("legacy message has a version:\n%s", data)
+	}
+
+	conv, err := ReadConversation(store, convpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrated, kept, err := conv.Migrate(store, alice)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(migrated) != 1 || migrated[0] != m1.Name() || len(kept) != 1 || kept[0] != m2.Name() {
+		t.Fatalf("migrated %v and kept %v", migrated, kept)
+	}
+
+	conv, err = ReadConversation(store, convpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got1, got2 := conv.Messages[0], conv.Messages[1]
+	if got1.FormatVersion() != msgVersion || got2.FormatVersion() != 1 {
+		t.Errorf("got versions %v and %v", got1.FormatVersion(), got2.FormatVersion())
+	}
+	if err := got1.verifyKey(alice.f.PublicKey()); err != nil {
+		t.Errorf("migrated message doesn't verify: %v", err)
+	}
+	orig, err := got1.Unmigrated()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := orig.verifyKey(alice.f.PublicKey()); err != nil {
+		t.Errorf("original signature doesn't verify: %v", err)
+	}
+	if err := got2.verifyKey(bob.f.PublicKey()); err != nil {
+		t.Errorf("kept message doesn't verify: %v", err)
+	}
+
+	// unknown versions are rejected
+	payload, _ := got1.Payload()
+	future := strings.Replace(payload, fmt.Sprintf(`"Version": %v`, msgVersion), `"Version": 99`, 1)
+	if _, err := ParseMessage(strings.NewReader(future)); err == nil {
+		t.Errorf("parsed message with unknown version")
+	}
+}
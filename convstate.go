@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"path"
+
+	"upspin.io/upspin"
+)
+
+// stateFile is the local state file holding conversation states.
+const stateFile = "conversations.json"
+
+// ConvState is our local, unshared state for a conversation.
+type ConvState struct {
+	// Archived conversations are hidden from list and sync -all.
+	Archived bool `json:",omitempty"`
+	// Muted conversations are synchronized without running hooks.
+	Muted bool `json:",omitempty"`
+	// Deleted conversations have had our copy removed and are ignored even
+	// if their directory reappears.
+	Deleted bool `json:",omitempty"`
+}
+
+// ConvStates holds the local state of conversations by their path in our
+// tree.  Conversations without an entry have the zero state.
+type ConvStates map[upspin.PathName]*ConvState
+
+// Get returns the state of the conversation at convpath.
+func (cs ConvStates) Get(convpath upspin.PathName) ConvState {
+	if st := cs[convpath]; st != nil {
+		return *st
+	}
+	return ConvState{}
+}
+
+// Set replaces the state of the conversation at convpath, dropping its entry
+// if st is the zero state.
+func (cs ConvStates) Set(convpath upspin.PathName, st ConvState) {
+	if st == (ConvState{}) {
+		delete(cs, convpath)
+		return
+	}
+	cs[convpath] = &st
+}
+
+// Active returns the conversations in convpaths that are neither archived
+// nor deleted.
+func (cs ConvStates) Active(convpaths []upspin.PathName) []upspin.PathName {
+	var active []upspin.PathName
+	for _, p := range convpaths {
+		if st := cs.Get(p); !st.Archived && !st.Deleted {
+			active = append(active, p)
+		}
+	}
+	return active
+}
+
+// CheckSync returns an error if the conversation at convpath, named
+// explicitly, mustn't be synchronized because our copy was deleted.
+func (cs ConvStates) CheckSync(convpath upspin.PathName) error {
+	if cs.Get(convpath).Deleted {
+		return fmt.Errorf("our copy of '%v' was deleted; unarchive it to sync it again", path.Base(string(convpath)))
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"path"
+	"reflect"
+	"testing"
+
+	"upspin.io/upspin"
+)
+
+func TestConvStates(t *testing.T) {
+	states := ConvStates{}
+	states.Set("a@x.com/converse/one", ConvState{Archived: true})
+	states.Set("a@x.com/converse/two", ConvState{Muted: true})
+	states.Set("a@x.com/converse/three", ConvState{Deleted: true})
+	states.Set("a@x.com/converse/four", ConvState{})
+	if _, ok := states["a@x.com/converse/four"]; ok {
+		t.Errorf("zero state stored")
+	}
+
+	all := []upspin.PathName{"a@x.com/converse/one", "a@x.com/converse/two", "a@x.com/converse/three", "a@x.com/converse/four"}
+	want := []upspin.PathName{"a@x.com/converse/two", "a@x.com/converse/four"}
+	if got := states.Active(all); !reflect.DeepEqual(got, want) {
+		t.Errorf("active %v, want %v", got, want)
+	}
+	if !states.Get("a@x.com/converse/two").Muted {
+		t.Errorf("mute not recorded")
+	}
+	if err := states.CheckSync("a@x.com/converse/three"); err == nil {
+		t.Errorf("deleted conversation may be synced by title")
+	}
+	if err := states.CheckSync("a@x.com/converse/one"); err != nil {
+		t.Errorf("archived conversation may not be synced by title: %v", err)
+	}
+}
+
+func TestRemoveAll(t *testing.T) {
+	store := newMemClient()
+	dir := ConvPath("alice@example.com", "plans")
+	for _, p := range []upspin.PathName{Join(dir, "Access"), Join(dir, "msg1-alice@example.com.txt"), Join(dir, tombstoneDir, "msg2-alice@example.com.txt")} {
+		if err := MakeDirs(store, upspin.PathName(path.Dir(string(p)))); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Put(p, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := RemoveAll(store, dir, true); err != nil {
+		t.Fatal(err)
+	}
+	ents, _ := store.Glob(string(Join(dir, "*")))
+	if len(ents) != 1 || ents[0].SignedName != Join(dir, "Access") {
+		t.Errorf("left %v, want only the Access file", ents)
+	}
+
+	if err := RemoveAll(store, dir, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Lookup(dir, false); err == nil {
+		t.Errorf("directory not removed")
+	}
+}
+
+func TestRevokeAccess(t *testing.T) {
+	store := newMemClient()
+	dir := ConvPath("alice@example.com", "plans")
+	if err := MakeDirs(store, dir); err != nil {
+		t.Fatal(err)
+	}
+	access := "*: alice@example.com\nread,create,list: bob@example.com, alice@example.com\nread,list: carol@example.com/Group/friends"
+	if _, err := store.Put(Join(dir, "Access"), []byte(access)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RevokeAccess(store, dir, "alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := store.Get(Join(dir, "Access"))
+	if err != nil {
+		t.Fatal(err)
+	} else if want := "*: alice@example.com\nread,create,list: alice@example.com"; string(data) != want {
+		t.Errorf("Access file %q, want %q", data, want)
+	}
+}
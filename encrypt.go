@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"strings"
+
+	"upspin.io/factotum"
+	"upspin.io/upspin"
+)
+
+const encryptedPlaceholder = "*[encrypted message]*"
+
+// Encryption describes the readers of a message whose content is encrypted.
+// The content is encrypted with a random AES-256-GCM message key that is
+// wrapped for each reader's public key.
+type Encryption struct {
+	Keys []WrappedKey
+}
+
+// WrappedKey holds a message key encrypted for a single reader.  The wrapping
+// key is the SHA-256 hash of the x coordinate of the ECDH shared point
+// between an ephemeral key and the reader's public key.
+type WrappedKey struct {
+	Reader upspin.UserName
+	// KeyHash is the hex encoded SHA-256 hash of the reader's public key.
+	KeyHash string
+	// Ephemeral is the hex encoded marshaled ephemeral public key.
+	Ephemeral string
+	// Key is the base64 encoded AES-GCM sealed message key.
+	Key string
+}
+
+// Encrypt encrypts the message body for the given readers (and the message's
+// author) using their public keys from the key server.  It must be called
+// before the message is signed.
+func (m *Message) Encrypt(c upspin.Config, readers []upspin.UserName) error {
+	keys := map[upspin.UserName]upspin.PublicKey{}
+	for _, u := range append([]upspin.UserName{m.Author}, readers...) {
+		if _, ok := keys[u]; ok {
+			continue
+		}
+		key, err := lookup(c, u)
+		if err != nil {
+			return fmt.Errorf("failed to find public key for %v: %v", u, err)
+		}
+		keys[u] = key
+	}
+	return m.EncryptFor(keys)
+}
+
+// EncryptFor encrypts the message body for readers with the given public
+// keys.  It must be called before the message is signed.
+func (m *Message) EncryptFor(keys map[upspin.UserName]upspin.PublicKey) error {
+	if m.IsSigned() {
+		return errors.New("cannot encrypt a signed message")
+	} else if m.Encryption != nil {
+		return errors.New("message is already encrypted")
+	}
+
+	plain, err := ioutil.ReadAll(m.Body)
+	if err != nil {
+		return err
+	}
+	msgKey := make([]byte, 32)
+	if _, err := rand.Read(msgKey); err != nil {
+		return err
+	}
+	ciphertext, err := aeadSeal(msgKey, plain, nil)
+	if err != nil {
+		return err
+	}
+
+	enc := &Encryption{}
+	for u, key := range keys {
+		wk, err := wrapKey(u, key, msgKey)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt for %v: %v", u, err)
+		}
+		enc.Keys = append(enc.Keys, wk)
+	}
+
+	m.Encryption = enc
+	m.plain, m.decrypted = string(plain), true
+	m.Body = bytes.NewBufferString(armor(ciphertext))
+	return nil
+}
+
+// Decrypt decrypts the content of an encrypted message using the private key
+// held by c's factotum.  Unencrypted and already decrypted messages are left
+// as they are.
+func (m *Message) Decrypt(c upspin.Config) error {
+	if m.Encryption == nil || m.decrypted {
+		return nil
+	}
+
+	var lastErr error
+	for _, wk := range m.Encryption.Keys {
+		if wk.Reader != c.UserName() {
+			continue
+		}
+		msgKey, err := unwrapKey(c.Factotum(), wk)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		ciphertext, err := base64.StdEncoding.DecodeString(strings.Replace(m.content, "\n", "", -1))
+		if err != nil {
+			return fmt.Errorf("malformed encrypted content in %v: %v", m.Name(), err)
+		}
+		plain, err := aeadOpen(msgKey, ciphertext, nil)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt %v: %v", m.Name(), err)
+		}
+		m.plain, m.decrypted = string(plain), true
+		return nil
+	}
+	if lastErr != nil {
+		return fmt.Errorf("failed to decrypt %v: %v", m.Name(), lastErr)
+	}
+	return fmt.Errorf("message %v is not encrypted for %v", m.Name(), c.UserName())
+}
+
+// IsEncrypted reports whether the message content is encrypted.
+func (m *Message) IsEncrypted() bool { return m.Encryption != nil }
+
+// sealed returns m or, if m was decrypted, a copy of m that doesn't expose
+// its decrypted content.
+func (m *Message) sealed() *Message {
+	if !m.decrypted {
+		return m
+	}
+	cp := *m
+	cp.plain, cp.decrypted = "", false
+	return &cp
+}
+
+func wrapKey(u upspin.UserName, key upspin.PublicKey, msgKey []byte) (WrappedKey, error) {
+	pub, _, err := factotum.ParsePublicKey(key)
+	if err != nil {
+		return WrappedKey{}, err
+	}
+	eph, err := ecdsa.GenerateKey(pub.Curve, rand.Reader)
+	if err != nil {
+		return WrappedKey{}, err
+	}
+	sx, _ := pub.Curve.ScalarMult(pub.X, pub.Y, eph.D.Bytes())
+
+	hash := keyHash(key)
+	wrapped, err := aeadSeal(wrappingKey(sx), msgKey, []byte(hex.EncodeToString(hash)))
+	if err != nil {
+		return WrappedKey{}, err
+	}
+	return WrappedKey{
+		Reader:    u,
+		KeyHash:   hex.EncodeToString(hash),
+		Ephemeral: hex.EncodeToString(elliptic.Marshal(pub.Curve, eph.X, eph.Y)),
+		Key:       base64.StdEncoding.EncodeToString(wrapped),
+	}, nil
+}
+
+func unwrapKey(f upspin.Factotum, wk WrappedKey) ([]byte, error) {
+	hash, err := hex.DecodeString(wk.KeyHash)
+	if err != nil {
+		return nil, err
+	}
+	eph, err := hex.DecodeString(wk.Ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	curve, err := curveFor(eph)
+	if err != nil {
+		return nil, err
+	}
+	ex, ey := elliptic.Unmarshal(curve, eph)
+	if ex == nil {
+		return nil, errors.New("invalid ephemeral key")
+	}
+
+	sx, _, err := f.ScalarMult(hash, curve, ex, ey)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(wk.Key)
+	if err != nil {
+		return nil, err
+	}
+	return aeadOpen(wrappingKey(sx), wrapped, []byte(wk.KeyHash))
+}
+
+// curveFor returns the curve of a marshaled (uncompressed) point.
+func curveFor(point []byte) (elliptic.Curve, error) {
+	for _, c := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		if len(point) == 1+2*((c.Params().BitSize+7)/8) {
+			return c, nil
+		}
+	}
+	return nil, errors.New("unsupported curve")
+}
+
+func wrappingKey(sx *big.Int) []byte {
+	h := sha256.Sum256(sx.Bytes())
+	return h[:]
+}
+
+func keyHash(key upspin.PublicKey) []byte {
+	h := sha256.Sum256([]byte(key))
+	return h[:]
+}
+
+// aeadSeal encrypts data with AES-GCM, prefixing the result with the nonce.
+func aeadSeal(key, data, additional []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, data, additional), nil
+}
+
+func aeadOpen(key, data, additional []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("encrypted data too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], additional)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// armor base64 encodes data in lines of 64 characters.
+func armor(data []byte) string {
+	s := base64.StdEncoding.EncodeToString(data)
+	var buf bytes.Buffer
+	for len(s) > 64 {
+		buf.WriteString(s[:64] + "\n")
+		s = s[64:]
+	}
+	buf.WriteString(s)
+	return buf.String()
+}
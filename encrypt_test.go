@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"upspin.io/upspin"
+)
+
+func TestEncrypt(t *testing.T) {
+	const text = "the launch codes are 0000"
+	alice := newTestConfig(t, "alice@example.com")
+	bob := newTestConfig(t, "bob@example.com")
+	carol := newTestConfig(t, "carol@example.com")
+
+	m := NewMessage(alice.UserName(), "secrets", "", bytes.NewBufferString(text))
+	keys := map[upspin.UserName]upspin.PublicKey{
+		alice.UserName(): alice.f.PublicKey(),
+		bob.UserName():   bob.f.PublicKey(),
+	}
+	if err := m.EncryptFor(keys); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := m.Sign(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(payload, text) {
+		t.Fatalf("payload contains plaintext:\n%v", payload)
+	}
+
+	parsed, err := ParseMessage(bytes.NewBufferString(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.IsEncrypted() || parsed.Content() != encryptedPlaceholder {
+		t.Errorf("want placeholder content before decryption, got %q", parsed.Content())
+	}
+	if payload2, err := parsed.Payload(); err != nil {
+		t.Fatal(err)
+	} else if payload2 != payload {
+		t.Errorf("payloads not equal:\n\npayload1:\n%v\n\npayload2:\n%v\n", payload, payload2)
+	}
+
+	if err := parsed.Decrypt(carol); err == nil {
+		t.Error("non-reader decrypted message")
+	}
+	if err := parsed.Decrypt(bob); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Content() != text {
+		t.Errorf("want decrypted content %q, got %q", text, parsed.Content())
+	}
+	if sealed := parsed.sealed(); sealed.Content() != encryptedPlaceholder {
+		t.Errorf("sealed copy exposes content %q", sealed.Content())
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"path"
+	"sort"
+	"testing"
+
+	"upspin.io/upspin"
+)
+
+// memClient is an in-memory stand-in for an upspin client.  Like an upspin
+// directory server, it bumps the sequence number of every directory above a
+// changed item.  Methods not implemented here panic.
+type memClient struct {
+	upspin.Client
+	files map[upspin.PathName][]byte
+	dirs  map[upspin.PathName]bool
+	seqs  map[upspin.PathName]int64
+	seq   int64
+}
+
+func newMemClient() *memClient {
+	return &memClient{
+		files: map[upspin.PathName][]byte{},
+		dirs:  map[upspin.PathName]bool{},
+		seqs:  map[upspin.PathName]int64{},
+	}
+}
+
+// touch gives p and all its parent directories a new sequence number.
+func (c *memClient) touch(p upspin.PathName) {
+	c.seq++
+	for ; p != "." && p != "/"; p = upspin.PathName(path.Dir(string(p))) {
+		c.seqs[p] = c.seq
+	}
+}
+
+func (c *memClient) Get(p upspin.PathName) ([]byte, error) {
+	data, ok := c.files[p]
+	if !ok {
+		return nil, fmt.Errorf("%v: item does not exist", p)
+	}
+	return append([]byte{}, data...), nil
+}
+
+func (c *memClient) Put(p upspin.PathName, data []byte) (*upspin.DirEntry, error) {
+	if c.dirs[p] {
+		return nil, fmt.Errorf("%v: is a directory", p)
+	}
+	c.files[p] = append([]byte{}, data...)
+	c.touch(p)
+	return c.Lookup(p, false)
+}
+
+func (c *memClient) Lookup(p upspin.PathName, followFinal bool) (*upspin.DirEntry, error) {
+	if c.dirs[p] {
+		return &upspin.DirEntry{SignedName: p, Name: p, Attr: upspin.AttrDirectory, Sequence: c.seqs[p]}, nil
+	} else if data, ok := c.files[p]; ok {
+		return &upspin.DirEntry{SignedName: p, Name: p, Sequence: c.seqs[p], Blocks: []upspin.DirBlock{{Size: int64(len(data))}}}, nil
+	}
+	return nil, fmt.Errorf("%v: item does not exist", p)
+}
+
+func (c *memClient) MakeDirectory(p upspin.PathName) (*upspin.DirEntry, error) {
+	if _, err := c.Lookup(p, false); err == nil {
+		return nil, fmt.Errorf("%v: item already exists", p)
+	}
+	c.dirs[p] = true
+	c.touch(p)
+	return c.Lookup(p, false)
+}
+
+func (c *memClient) Delete(p upspin.PathName) error {
+	if _, err := c.Lookup(p, false); err != nil {
+		return err
+	}
+	delete(c.files, p)
+	delete(c.dirs, p)
+	delete(c.seqs, p)
+	c.touch(upspin.PathName(path.Dir(string(p))))
+	return nil
+}
+
+func (c *memClient) Glob(pattern string) ([]*upspin.DirEntry, error) {
+	var names []string
+	for p := range c.files {
+		names = append(names, string(p))
+	}
+	for p := range c.dirs {
+		names = append(names, string(p))
+	}
+	sort.Strings(names)
+
+	var ents []*upspin.DirEntry
+	for _, name := range names {
+		if ok, _ := path.Match(pattern, name); ok {
+			ent, _ := c.Lookup(upspin.PathName(name), false)
+			ents = append(ents, ent)
+		}
+	}
+	return ents, nil
+}
+
+func (c *memClient) Create(p upspin.PathName) (upspin.File, error) {
+	return &memFile{c: c, name: p, w: new(bytes.Buffer)}, nil
+}
+
+func (c *memClient) Open(p upspin.PathName) (upspin.File, error) {
+	data, err := c.Get(p)
+	if err != nil {
+		return nil, err
+	}
+	return &memFile{c: c, name: p, r: bytes.NewReader(data)}, nil
+}
+
+// memFile is a file opened for either reading or writing on a memClient.
+type memFile struct {
+	upspin.File
+	c    *memClient
+	name upspin.PathName
+	r    *bytes.Reader
+	w    *bytes.Buffer
+}
+
+func (f *memFile) Name() upspin.PathName                { return f.name }
+func (f *memFile) Read(b []byte) (int, error)           { return f.r.Read(b) }
+func (f *memFile) Write(b []byte) (int, error)          { return f.w.Write(b) }
+func (f *memFile) Seek(off int64, w int) (int64, error) { return f.r.Seek(off, w) }
+
+func (f *memFile) Close() error {
+	if f.w != nil {
+		_, err := f.c.Put(f.name, f.w.Bytes())
+		return err
+	}
+	return nil
+}
+
+// testConfig is an upspin config for a user with a freshly generated key.
+// Methods not implemented here panic.
+type testConfig struct {
+	upspin.Config
+	user upspin.UserName
+	f    *testFactotum
+}
+
+func newTestConfig(t testing.TB, user upspin.UserName) *testConfig {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testConfig{user: user, f: &testFactotum{key: key}}
+}
+
+func (c *testConfig) UserName() upspin.UserName { return c.user }
+func (c *testConfig) Factotum() upspin.Factotum { return c.f }
+
+type testFactotum struct {
+	upspin.Factotum
+	key *ecdsa.PrivateKey
+}
+
+func (f *testFactotum) Sign(hash []byte) (upspin.Signature, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, f.key, hash)
+	return upspin.Signature{R: r, S: s}, err
+}
+
+func (f *testFactotum) PublicKey() upspin.PublicKey {
+	return upspin.PublicKey(fmt.Sprintf("p256\n%s\n%s\n", f.key.X, f.key.Y))
+}
+
+func (f *testFactotum) ScalarMult(hash []byte, c elliptic.Curve, x, y *big.Int) (*big.Int, *big.Int, error) {
+	if !bytes.Equal(hash, keyHash(f.PublicKey())) {
+		return nil, nil, fmt.Errorf("no key with hash %x", hash)
+	}
+	sx, sy := c.ScalarMult(x, y, f.key.D.Bytes())
+	return sx, sy, nil
+}
+
+// useKeys makes ReadConversation verify with keys until the test ends.
+func useKeys(t testing.TB, keys TrustedKeys) {
+	old := ConversationKeys
+	t.Cleanup(func() { ConversationKeys = old })
+	ConversationKeys = keys.Key
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"time"
+
+	"github.com/russross/blackfriday"
+)
+
+// feedFile is the Atom feed published for announcements.
+const feedFile = "feed.xml"
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Content atomContent `xml:"content"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// Feed renders the conversation's messages as an Atom feed, newest first.
+// Retracted, pruned and hidden messages are left out.
+func (c *Conversation) Feed() ([]byte, error) {
+	feed := &atomFeed{ID: "upspin:" + string(c.Location), Title: c.DisplayName()}
+	var updated time.Time
+	for i := len(c.Messages) - 1; i >= 0; i-- {
+		m := c.Messages[i]
+		if m.IsRetracted() || m.IsPruned() || m.IsHidden() {
+			continue
+		}
+		if m.Time.After(updated) {
+			updated = m.Time
+		}
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:      "upspin:" + string(Join(c.Location, string(m.Name()))),
+			Title:   fmt.Sprintf("%v (msg %v)", c.DisplayName(), i+1),
+			Updated: m.Time.UTC().Format(time.RFC3339),
+			Author:  atomAuthor{Name: m.From()},
+			Content: atomContent{Type: "html", Body: string(blackfriday.MarkdownCommon([]byte(m.Content())))},
+		})
+	}
+	feed.Updated = updated.UTC().Format(time.RFC3339)
+
+	data, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
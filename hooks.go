@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"time"
+
+	"upspin.io/upspin"
+)
+
+// isMsgFile reports whether the file at p is named like a conversation message.
+func isMsgFile(p upspin.PathName) bool {
+	_, err := ParseMsgName(path.Base(string(p)))
+	return err == nil
+}
+
+// hookMessage is the JSON form of a message passed to hooks.
+type hookMessage struct {
+	Name          MsgName
+	Author        upspin.UserName
+	Title         string
+	Time          time.Time
+	ParentMessage MsgName
+	Origin        *Origin `json:",omitempty"`
+	Content       string
+}
+
+// RunHook executes the shell command hook for message m of the conversation
+// at convpath.  The message is passed as JSON on stdin and the conversation
+// path, message author and message name in the environment variables
+// CONVERSE_CONVERSATION, CONVERSE_AUTHOR and CONVERSE_MSG.
+func RunHook(hook string, convpath upspin.PathName, m *Message) error {
+	data, err := json.Marshal(hookMessage{
+		Name:          m.Name(),
+		Author:        m.Author,
+		Title:         m.Title,
+		Time:          m.Time,
+		ParentMessage: m.Parent,
+		Origin:        m.Origin,
+		Content:       m.Content(),
+	})
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("sh", "-c", hook)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"CONVERSE_CONVERSATION="+string(convpath),
+		"CONVERSE_AUTHOR="+string(m.Author),
+		"CONVERSE_MSG="+string(m.Name()),
+	)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("hook '%v' failed for %v: %v", hook, m.Name(), err)
+	}
+	return nil
+}
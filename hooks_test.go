@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "converse-hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	hook := `cat > ` + out + ` && echo "$CONVERSE_AUTHOR $CONVERSE_MSG $CONVERSE_CONVERSATION" >> ` + out + `.env`
+
+	m := NewMessage("alice@example.com", "plans", "", bytes.NewBufferString("hi"))
+	m.content = "hi"
+	if err := RunHook(hook, "alice@example.com/conversations/plans", m); err != nil {
+		t.Fatal(err)
+	}
+
+	var got hookMessage
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != m.Name() || got.Content != "hi" {
+		t.Errorf("hook received wrong message: %s", data)
+	}
+
+	env, err := ioutil.ReadFile(out + ".env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "alice@example.com msg1-alice@example.com.txt alice@example.com/conversations/plans\n"
+	if string(env) != want {
+		t.Errorf("want hook env %q, got %q", want, env)
+	}
+
+	if err := RunHook("exit 3", "alice@example.com/conversations/plans", m); err == nil {
+		t.Error("failing hook returned no error")
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"upspin.io/upspin"
+)
+
+const emailSource = "email"
+
+// Email is a single message from an email thread.
+type Email struct {
+	From      string
+	Subject   string
+	Date      time.Time
+	MessageID string
+	InReplyTo string
+	Body      string
+}
+
+// ParseEmail parses an RFC 5322 message, extracting its plain text body.
+func ParseEmail(r io.Reader) (*Email, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	h := msg.Header
+	e := &Email{
+		From:      h.Get("From"),
+		MessageID: strings.TrimSpace(h.Get("Message-Id")),
+		InReplyTo: firstMsgID(h.Get("In-Reply-To")),
+	}
+	if addr, err := mail.ParseAddress(e.From); err == nil {
+		e.From = addr.Address
+	}
+	if e.InReplyTo == "" {
+		// fall back to the last (most recent) entry in References
+		refs := strings.Fields(h.Get("References"))
+		if len(refs) > 0 {
+			e.InReplyTo = refs[len(refs)-1]
+		}
+	}
+
+	dec := new(mime.WordDecoder)
+	e.Subject, err = dec.DecodeHeader(h.Get("Subject"))
+	if err != nil {
+		e.Subject = h.Get("Subject")
+	}
+
+	e.Date, err = h.Date()
+	if err != nil {
+		return nil, fmt.Errorf("email %v has invalid date: %v", e.MessageID, err)
+	}
+
+	body, err := textBody(h.Get("Content-Type"), h.Get("Content-Transfer-Encoding"), msg.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body of email %v: %v", e.MessageID, err)
+	}
+	e.Body = strings.TrimSpace(strings.Replace(body, "\r\n", "\n", -1))
+	return e, nil
+}
+
+// textBody returns the text/plain content of a (possibly multipart) email body.
+func textBody(contentType, encoding string, r io.Reader) (string, error) {
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", err
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(r, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return "", nil
+			} else if err != nil {
+				return "", err
+			}
+			body, err := textBody(p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"), p)
+			if err != nil {
+				return "", err
+			} else if body != "" {
+				return body, nil
+			}
+		}
+	} else if mediaType != "text/plain" {
+		return "", nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func firstMsgID(s string) string {
+	i := strings.Index(s, "<")
+	j := strings.Index(s, ">")
+	if i < 0 || j < i {
+		return strings.TrimSpace(s)
+	}
+	return s[i : j+1]
+}
+
+// ReadMbox parses all messages from an mbox formatted stream.
+func ReadMbox(r io.Reader) ([]*Email, error) {
+	var emails []*Email
+	var buf bytes.Buffer
+	flush := func() error {
+		if buf.Len() == 0 {
+			return nil
+		}
+		e, err := ParseEmail(&buf)
+		if err != nil {
+			return err
+		}
+		emails = append(emails, e)
+		buf.Reset()
+		return nil
+	}
+
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<20)
+	prevBlank := true
+	for s.Scan() {
+		line := s.Text()
+		if prevBlank && strings.HasPrefix(line, "From ") {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			prevBlank = false
+			continue
+		}
+		prevBlank = line == ""
+		if strings.HasPrefix(line, ">From ") {
+			line = line[1:]
+		}
+		buf.WriteString(line + "\n")
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return emails, nil
+}
+
+// ReadMaildir parses all messages in the "cur" and "new" subdirectories of
+// a Maildir directory.
+func ReadMaildir(dir string) ([]*Email, error) {
+	var emails []*Email
+	for _, sub := range []string{"cur", "new"} {
+		files, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, fi := range files {
+			if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+				continue
+			}
+			e, err := readEmailFile(filepath.Join(dir, sub, fi.Name()))
+			if err != nil {
+				return nil, err
+			}
+			emails = append(emails, e)
+		}
+	}
+	return emails, nil
+}
+
+func readEmailFile(fname string) (*Email, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	e, err := ParseEmail(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse email '%v': %v", fname, err)
+	}
+	return e, nil
+}
+
+// ThreadTitle returns a conversation title derived from the subject of the
+// earliest email in a thread.
+func ThreadTitle(emails []*Email) string {
+	var first *Email
+	for _, e := range emails {
+		if first == nil || e.Date.Before(first.Date) {
+			first = e
+		}
+	}
+	if first == nil {
+		return ""
+	}
+	title := strings.TrimSpace(first.Subject)
+	for {
+		lower := strings.ToLower(title)
+		if !strings.HasPrefix(lower, "re:") && !strings.HasPrefix(lower, "fwd:") {
+			break
+		}
+		title = strings.TrimSpace(title[strings.Index(title, ":")+1:])
+	}
+	return strings.Replace(title, "/", "-", -1)
+}
+
+// Import adds the emails to the conversation in date order as messages
+// authored and signed by user with each email's original sender recorded in
+// the message's Origin.  Each message's parent is the message for the email
+// it replies to where that doesn't collide with an existing message name;
+// otherwise it is appended to the end of the conversation.
+func (c *Conversation) Import(user upspin.UserName, emails []*Email) []*Message {
+	if c.Title() == "" {
+		panic("cannot import messages into untitled conversation")
+	}
+
+	sorted := append([]*Email{}, emails...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Date.Before(sorted[j].Date) })
+
+	used := map[MsgName]bool{}
+	byID := map[string]MsgName{}
+	last := c.nextParent()
+	for _, m := range c.Messages {
+		used[m.Name()] = true
+		if m.Origin != nil && m.Origin.MessageID != "" {
+			byID[m.Origin.MessageID] = m.Name()
+		}
+		if last == "" || m.Name().Number() > last.Number() {
+			last = m.Name()
+		}
+	}
+
+	var added []*Message
+	for _, e := range sorted {
+		if _, ok := byID[e.MessageID]; ok && e.MessageID != "" {
+			continue // already imported
+		}
+
+		parent := last
+		if p, ok := byID[e.InReplyTo]; ok && !used[p.NextName(user)] {
+			parent = p
+		}
+
+		m := NewMessage(user, c.Title(), parent, bytes.NewBufferString(e.Body))
+		m.Time = e.Date
+		m.Origin = &Origin{Source: emailSource, From: e.From, MessageID: e.MessageID, InReplyTo: e.InReplyTo}
+		c.Messages = append(c.Messages, m)
+		added = append(added, m)
+
+		used[m.Name()] = true
+		if e.MessageID != "" {
+			byID[e.MessageID] = m.Name()
+		}
+		if last == "" || m.Name().Number() > last.Number() {
+			last = m.Name()
+		}
+	}
+	return added
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+const testMbox = `From alice@example.com Mon Jan  2 15:04:05 2017
+From: Alice <alice@example.com>
+Subject: Re: Pick a database
+Date: Tue, 03 Jan 2017 10:00:00 +0000
+Message-Id: <2@example.com>
+In-Reply-To: <1@example.com>
+
+Postgres, please.
+>From what I've seen it is fine.
+
+From bob@example.com Mon Jan  2 15:04:05 2017
+From: Bob <bob@example.com>
+Subject: Pick a database
+Date: Mon, 02 Jan 2017 10:00:00 +0000
+Message-Id: <1@example.com>
+Content-Type: multipart/alternative; boundary="XX"
+
+--XX
+Content-Type: text/html
+
+<p>ignored</p>
+--XX
+Content-Type: text/plain
+Content-Transfer-Encoding: quoted-printable
+
+Which database should we =
+use?
+--XX--
+
+From carol@example.com Mon Jan  2 15:04:05 2017
+From: carol@example.com
+Subject: Re: Pick a database
+Date: Wed, 04 Jan 2017 10:00:00 +0000
+Message-Id: <3@example.com>
+References: <1@example.com>
+
+Sqlite!
+`
+
+func TestReadMbox(t *testing.T) {
+	emails, err := ReadMbox(bytes.NewBufferString(testMbox))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 3 {
+		t.Fatalf("want 3 emails, got %v", len(emails))
+	}
+
+	e := emails[0]
+	if e.From != "alice@example.com" || e.InReplyTo != "<1@example.com>" {
+		t.Errorf("bad header parse: %+v", e)
+	}
+	if want := "Postgres, please.\nFrom what I've seen it is fine."; e.Body != want {
+		t.Errorf("want body %q, got %q", want, e.Body)
+	}
+	if want := "Which database should we use?"; emails[1].Body != want {
+		t.Errorf("want multipart body %q, got %q", want, emails[1].Body)
+	}
+	if emails[2].InReplyTo != "<1@example.com>" {
+		t.Errorf("References not used as parent: got %q", emails[2].InReplyTo)
+	}
+	if title := ThreadTitle(emails); title != "Pick a database" {
+		t.Errorf("want thread title 'Pick a database', got %q", title)
+	}
+}
+
+func TestImport(t *testing.T) {
+	emails, err := ReadMbox(bytes.NewBufferString(testMbox))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const importer = "importer@example.com"
+	conv := NewConversation(DefaultRoot(importer), ThreadTitle(emails))
+	msgs := conv.Import(importer, emails)
+	if len(msgs) != 3 {
+		t.Fatalf("want 3 imported messages, got %v", len(msgs))
+	}
+
+	wantParents := []MsgName{"", NewMsgName(importer, 1), NewMsgName(importer, 2)}
+	wantFrom := []string{"bob@example.com", "alice@example.com", "carol@example.com"}
+	for i, m := range msgs {
+		if m.Author != importer {
+			t.Errorf("msg %v: want author %v, got %v", i, importer, m.Author)
+		}
+		if m.Parent != wantParents[i] {
+			t.Errorf("msg %v: want parent %q, got %q", i, wantParents[i], m.Parent)
+		}
+		if m.Origin == nil || m.Origin.From != wantFrom[i] {
+			t.Errorf("msg %v: want origin from %v, got %+v", i, wantFrom[i], m.Origin)
+		}
+	}
+
+	// re-importing the same thread adds nothing
+	if msgs := conv.Import(importer, emails); len(msgs) != 0 {
+		t.Errorf("re-import added %v messages", len(msgs))
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"upspin.io/upspin"
+)
+
+// SupersededKeyError reports a message whose signature is valid for a key the
+// author has since replaced.
+type SupersededKeyError struct {
+	Author upspin.UserName
+	// Replaced is when the key was first seen to be replaced.
+	Replaced time.Time
+}
+
+func (e *SupersededKeyError) Error() string {
+	return fmt.Sprintf("signed with superseded key of %v (replaced by %v)", e.Author, e.Replaced.Format(time.UnixDate))
+}
+
+// KeyLookupError reports a failure to find a user's public key, as opposed to
+// a signature that fails to verify.  It may be transient.
+type KeyLookupError struct {
+	User upspin.UserName
+	Err  error
+}
+
+func (e *KeyLookupError) Error() string {
+	return fmt.Sprintf("failed to discover public key of %v: %v", e.User, e.Err)
+}
+
+// SeenKey is a public key observed for a user.
+type SeenKey struct {
+	Key       upspin.PublicKey
+	FirstSeen time.Time
+}
+
+// KeyRecord holds a user's current public key and every key previously seen
+// for them, oldest first.
+type KeyRecord struct {
+	Fetched time.Time
+	Keys    []SeenKey
+}
+
+func (r *KeyRecord) current() upspin.PublicKey { return r.Keys[len(r.Keys)-1].Key }
+
+// KeyCache caches users' public keys in a local file.  Keys are refetched once
+// they are older than TTL, and every key seen for a user is remembered so
+// that messages signed before a key rotation can still be checked.
+type KeyCache struct {
+	TTL   time.Duration
+	Users map[upspin.UserName]*KeyRecord
+	fname string
+	fetch func(upspin.UserName) (upspin.PublicKey, error)
+
+	mu sync.Mutex // guards Users
+}
+
+// OpenKeyCache loads the key cache stored in the local file fname (if any)
+// which fetches keys not in the cache using fetch.
+func OpenKeyCache(fname string, ttl time.Duration, fetch func(upspin.UserName) (upspin.PublicKey, error)) (*KeyCache, error) {
+	kc := &KeyCache{TTL: ttl, Users: map[upspin.UserName]*KeyRecord{}, fname: fname, fetch: fetch}
+	if fname == "" {
+		return kc, nil
+	}
+	if err := loadJSON(fname, &kc.Users); err != nil {
+		return nil, fmt.Errorf("failed to load key cache: %v", err)
+	}
+	return kc, nil
+}
+
+// Current returns the user's current public key, fetching it if the cached
+// key has expired.  A cached key is returned if fetching fails.
+func (kc *KeyCache) Current(u upspin.UserName) (upspin.PublicKey, error) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	rec := kc.Users[u]
+	if rec != nil && time.Since(rec.Fetched) < kc.TTL {
+		return rec.current(), nil
+	}
+
+	key, err := kc.fetch(u)
+	if err != nil {
+		if rec != nil {
+			return rec.current(), nil
+		}
+		return "", err
+	}
+
+	now := time.Now()
+	if rec == nil {
+		rec = &KeyRecord{}
+		kc.Users[u] = rec
+	}
+	rec.Fetched = now
+	if len(rec.Keys) == 0 || rec.current() != key {
+		rec.Keys = append(rec.Keys, SeenKey{Key: key, FirstSeen: now})
+	}
+
+	if kc.fname != "" {
+		if err := saveJSON(kc.fname, kc.Users); err != nil {
+			return "", fmt.Errorf("failed to save key cache: %v", err)
+		}
+	}
+	return key, nil
+}
+
+// Verify checks m's signature against its author's current key and, failing
+// that, against the author's previously seen keys.  A signature valid for a
+// superseded key yields a *SupersededKeyError if the message predates the
+// key's replacement and a verification error otherwise.  Failing to find the
+// author's key yields a *KeyLookupError.
+func (kc *KeyCache) Verify(m *Message) error {
+	key, err := kc.Current(m.Author)
+	if err != nil {
+		return &KeyLookupError{User: m.Author, Err: err}
+	}
+	err = m.verifyKey(key)
+	if err == nil {
+		return nil
+	}
+
+	kc.mu.Lock()
+	keys := append([]SeenKey{}, kc.Users[m.Author].Keys...)
+	kc.mu.Unlock()
+	for i := len(keys) - 2; i >= 0; i-- {
+		if m.verifyKey(keys[i].Key) != nil {
+			continue
+		}
+		replaced := keys[i+1].FirstSeen
+		if m.Time.After(replaced) {
+			return errors.New("signed with superseded key after it was replaced")
+		}
+		return &SupersededKeyError{Author: m.Author, Replaced: replaced}
+	}
+	return err
+}
+
+// TrustedKeys holds public keys supplied locally, used to verify messages
+// without consulting the key server.
+type TrustedKeys map[upspin.UserName]upspin.PublicKey
+
+// LoadTrustedKeys reads trusted keys from the local file fname.  Each line
+// holds a user name followed by the fields of the user's public key (as in
+// their public.upspinkey file) separated by spaces.  Blank lines and lines
+// starting with '#' are ignored.
+func LoadTrustedKeys(fname string) (TrustedKeys, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := TrustedKeys{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%v:%v: missing public key", fname, n)
+		}
+		keys[upspin.UserName(fields[0])] = upspin.PublicKey(strings.Join(fields[1:], "\n") + "\n")
+	}
+	return keys, scanner.Err()
+}
+
+// Key returns u's trusted key.
+func (tk TrustedKeys) Key(u upspin.UserName) (upspin.PublicKey, error) {
+	key, ok := tk[u]
+	if !ok {
+		return "", fmt.Errorf("no trusted key for %v", u)
+	}
+	return key, nil
+}
+
+// Verify checks m's signature against its author's trusted key.
+func (tk TrustedKeys) Verify(m *Message) error {
+	key, ok := tk[m.Author]
+	if !ok {
+		return fmt.Errorf("no trusted key for %v", m.Author)
+	}
+	return m.verifyKey(key)
+}
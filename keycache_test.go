@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"upspin.io/upspin"
+)
+
+func TestKeyCache(t *testing.T) {
+	const alice upspin.UserName = "alice@example.com"
+	oldcfg := newTestConfig(t, alice)
+	newcfg := newTestConfig(t, alice)
+
+	current, fetches := oldcfg.f.PublicKey(), 0
+	kc, err := OpenKeyCache("", time.Hour, func(u upspin.UserName) (upspin.PublicKey, error) {
+		fetches++
+		if u != alice {
+			return "", errors.New("no such user")
+		}
+		return current, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(cfg upspin.Config, when time.Time) *Message {
+		m := NewMessage(alice, "keys", "", bytes.NewBufferString("hello"))
+		m.Time = when
+		if _, err := m.Sign(cfg); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	before := sign(oldcfg, time.Now().Add(-time.Minute))
+	if err := kc.Verify(before); err != nil {
+		t.Fatal(err)
+	}
+	if err := kc.Verify(before); err != nil || fetches != 1 {
+		t.Fatalf("want 1 fetch within TTL, got %v (err %v)", fetches, err)
+	}
+
+	// alice rotates her key; expire the cache so the new key is fetched
+	current = newcfg.f.PublicKey()
+	kc.Users[alice].Fetched = time.Now().Add(-2 * time.Hour)
+
+	if err := kc.Verify(sign(newcfg, time.Now())); err != nil {
+		t.Errorf("message signed with new key failed: %v", err)
+	}
+	if _, ok := kc.Verify(before).(*SupersededKeyError); !ok {
+		t.Errorf("want SupersededKeyError for message signed before rotation, got %v", kc.Verify(before))
+	}
+
+	after := sign(oldcfg, time.Now().Add(time.Minute))
+	if err := kc.Verify(after); err == nil {
+		t.Error("message signed with old key after rotation verified")
+	} else if _, ok := err.(*SupersededKeyError); ok {
+		t.Errorf("want plain failure for message signed after rotation, got %v", err)
+	}
+
+	forged := sign(newTestConfig(t, alice), time.Now())
+	if err := kc.Verify(forged); err == nil {
+		t.Error("message signed with unknown key verified")
+	}
+}
+
+func TestTrustedKeys(t *testing.T) {
+	alice := newTestConfig(t, "alice@example.com")
+	bob := newTestConfig(t, "bob@example.com")
+
+	fname := filepath.Join(t.TempDir(), "keys")
+	data := "# pinned keys\n\n" + string(alice.UserName()) + " " + strings.Replace(string(alice.f.PublicKey()), "\n", " ", -1) + "\n"
+	if err := ioutil.WriteFile(fname, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tk, err := LoadTrustedKeys(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []*testConfig{alice, bob} {
+		m := NewMessage(c.UserName(), "plans", "", bytes.NewBufferString("hi"))
+		if _, err := m.Sign(c); err != nil {
+			t.Fatal(err)
+		}
+		err := tk.Verify(m)
+		if c == alice && err != nil {
+			t.Errorf("alice's message failed to verify: %v", err)
+		} else if c == bob && err == nil {
+			t.Errorf("bob's message verified without a trusted key")
+		}
+	}
+}
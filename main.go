@@ -4,12 +4,18 @@ import (
 	"bytes"
 	"flag"
 	"fmt"
+	"html/template"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
+	gosync "sync"
+	"text/tabwriter"
+	"time"
 
 	"github.com/bryanl/webbrowser"
 
@@ -32,26 +38,58 @@ func init() {
 const usage = `converse [flags...] <subcmd>`
 const subUsage = `
 Subcommands:
-	list     list all existing conversations
-	show     print all messages in a conversation
-	publish  render+save a conversation as html in its dir
-	download download an entire conversation
-	sync     synchronize a conversation from participants' dirs
-	create   create and print signed message 
-	send     send a created message
-	addfile  add a file to a conversation
-	verify   verify integrity of all messages in a conversation
+	list        list all existing conversations
+	show        print all messages in a conversation
+	publish     render+save a conversation as html in its dir
+	download    download an entire conversation
+	sync        synchronize a conversation from participants' dirs
+	create      create and print signed message
+	send        send a created message
+	addfile     add a file to a conversation
+	retract     retract a message you sent
+	migrate     re-sign your messages in the current message format
+	verify      verify integrity of all messages in a conversation
+	verify-file verify standalone message payloads against trusted keys
+	export      write a signed bundle of a conversation for backup or transfer
+	restore     restore a conversation from a bundle after verifying it
+	import      import an email thread (mbox or Maildir) as a conversation
+	bridge      relay conversations to and from email
+	daemon      periodically sync all conversations
+	bot         run an automated participant (e.g. "standup")
+	meta        show or update a conversation's description, tags and modes
+	rename      set a conversation's display name
+	archive     hide conversations from list and sync -all
+	unarchive   undo archive or delete
+	mute        stop running hooks for conversations
+	delete      delete our copy of a conversation
+	prune       delete old messages and large attachments by retention rules
+	subscribe   subscribe to an announcement conversation
+	promote     give a participant a more privileged role
+	demote      give a participant a less privileged role
+	hide        hide a message as a moderator
 `
 
 const defaultConfigPath = "$HOME/upspin/config"
+const defaultStateDir = "$HOME/upspin/converse"
+const defaultSettingsPath = "$HOME/upspin/converse.conf"
+
+// cursorFile is the local state file holding sync cursors.
+const cursorFile = "sync-cursors.json"
 
 var configPath = flag.String("config", defaultConfigPath, "upspin config file")
 var rootdir = flag.String("root", DefaultConverseDir, "root conversations directory")
+var statedir = flag.String("state", defaultStateDir, "directory for local converse state")
+var settingsPath = flag.String("settings", defaultSettingsPath, "converse settings file")
+var templatePath = flag.String("template", "", "html/template `file` for rendering conversations as html")
+var keyTTL = flag.Duration("keyttl", 24*time.Hour, "how long cached public keys are used before refetching")
 
 var cfg upspin.Config
 var cl upspin.Client
 var user upspin.UserName
 var root upspin.PathName
+var settings *Settings
+var keys *KeyCache
+var pageTemplate *template.Template
 
 func main() {
 	flag.Parse()
@@ -60,98 +98,355 @@ func main() {
 		os.Exit(1)
 	}
 
-	loadConfig(*configPath)
 	cmd := flag.Arg(0)
+	loadSettings(*settingsPath)
+	if cmd != "verify-file" && cmd != "restore" {
+		// these may run offline
+		loadConfig(*configPath)
+	}
 	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
 
 	switch cmd {
 	case "sync":
-		sync(fs, cmd, flag.Args()[1:])
+		synchronize(fs, cmd, flag.Args()[1:])
 	case "download":
 		download(fs, cmd, flag.Args()[1:])
 	case "publish":
 		publish(fs, cmd, flag.Args()[1:])
 	case "addfile":
 		addfile(fs, cmd, flag.Args()[1:])
+	case "retract":
+		retract(fs, cmd, flag.Args()[1:])
+	case "migrate":
+		migrate(fs, cmd, flag.Args()[1:])
 	case "show":
 		show(fs, cmd, flag.Args()[1:])
 	case "verify":
 		verify(fs, cmd, flag.Args()[1:])
+	case "verify-file":
+		verifyFile(fs, cmd, flag.Args()[1:])
+	case "export":
+		export(fs, cmd, flag.Args()[1:])
+	case "restore":
+		restore(fs, cmd, flag.Args()[1:])
 	case "create":
 		create(fs, cmd, flag.Args()[1:])
 	case "send":
 		send(fs, cmd, flag.Args()[1:])
 	case "list":
 		list(fs, cmd, flag.Args()[1:])
+	case "meta":
+		meta(fs, cmd, flag.Args()[1:])
+	case "rename":
+		rename(fs, cmd, flag.Args()[1:])
+	case "archive":
+		archive(fs, cmd, flag.Args()[1:])
+	case "unarchive":
+		unarchive(fs, cmd, flag.Args()[1:])
+	case "mute":
+		mute(fs, cmd, flag.Args()[1:])
+	case "delete":
+		deleteConv(fs, cmd, flag.Args()[1:])
+	case "subscribe":
+		subscribe(fs, cmd, flag.Args()[1:])
+	case "promote":
+		changeRole(fs, cmd, flag.Args()[1:], -1)
+	case "demote":
+		changeRole(fs, cmd, flag.Args()[1:], 1)
+	case "hide":
+		hide(fs, cmd, flag.Args()[1:])
+	case "prune":
+		prune(fs, cmd, flag.Args()[1:])
+	case "import":
+		importMail(fs, cmd, flag.Args()[1:])
+	case "bridge":
+		bridge(fs, cmd, flag.Args()[1:])
+	case "daemon":
+		daemon(fs, cmd, flag.Args()[1:])
+	case "bot":
+		runBot(fs, cmd, flag.Args()[1:])
 	default:
 		log.Fatalf("unrecognized subcommand '%v'", cmd)
 	}
 }
 
-func sync(fs *flag.FlagSet, cmd string, args []string) {
+func synchronize(fs *flag.FlagSet, cmd string, args []string) {
 	const usage = `<title>`
 	with := fs.String("with", "", "list of `users` to sync from")
 	all := fs.Bool("all", false, "true to sync all known conversations")
+	attach := fs.String("attachments", "allow", "policy for non-message files: allow, skip or quarantine")
+	conflicts := fs.String("conflicts", "author", "policy for revised or deleted files: author, keep or theirs")
+	full := fs.Bool("full", false, "examine every file instead of only those changed since the last sync")
+	workers := fs.Int("j", 8, "maximum number of concurrent syncs")
+	var hooks stringList
+	fs.Var(&hooks, "hook", "shell `command` to run for each newly synchronized message (repeatable)")
 	fs.Usage = mkUsage(fs, cmd, usage)
 	fs.Parse(args)
+	if !isSet(fs, "hook") {
+		hooks = settings.Hooks
+	}
 
 	if fs.NArg() != 1 && !*all {
 		log.Println("Need title argument")
 		fs.Usage()
 	}
 
+	states := loadStates()
 	convpaths := []upspin.PathName{}
 	if *all {
 		pths, err := ListConversations(cl, root)
 		check(err)
-		convpaths = append(convpaths, pths...)
+		convpaths = append(convpaths, states.Active(pths)...)
 	} else {
-		convpaths = append(convpaths, ConvPath(user, fs.Arg(0)))
+		convpath := ConvPath(user, fs.Arg(0))
+		check(states.CheckSync(convpath))
+		convpaths = append(convpaths, convpath)
+	}
+
+	policy, err := ParseAttachmentPolicy(*attach)
+	check(err)
+	conflict, err := ParseConflictPolicy(*conflicts)
+	check(err)
+	s := &Syncer{Client: cl, Verify: keys.Verify, Keys: keys.Current, Attachments: policy, Conflicts: conflict, Full: *full}
+	check(loadJSON(statePath(cursorFile), &s.Cursors))
+	if s.Cursors == nil {
+		s.Cursors = map[upspin.PathName]*Cursor{}
+	}
+	err = syncConversations(s, convpaths, *with, hooks, states, *workers)
+	check(saveJSON(statePath(cursorFile), s.Cursors))
+	check(err)
+}
+
+func daemon(fs *flag.FlagSet, cmd string, args []string) {
+	const usage = ``
+	every := fs.Duration("every", 5*time.Minute, "interval between synchronizations")
+	attach := fs.String("attachments", "allow", "policy for non-message files: allow, skip or quarantine")
+	conflicts := fs.String("conflicts", "author", "policy for revised or deleted files: author, keep or theirs")
+	workers := fs.Int("j", 8, "maximum number of concurrent syncs")
+	var hooks stringList
+	fs.Var(&hooks, "hook", "shell `command` to run for each newly synchronized message (repeatable)")
+	fs.Usage = mkUsage(fs, cmd, usage)
+	fs.Parse(args)
+	if !isSet(fs, "hook") {
+		hooks = settings.Hooks
+	}
+	if !isSet(fs, "every") && settings.SyncInterval > 0 {
+		*every = settings.SyncInterval
+	}
+
+	if fs.NArg() != 0 {
+		log.Println("Takes no arguments")
+		fs.Usage()
+	}
+
+	policy, err := ParseAttachmentPolicy(*attach)
+	check(err)
+	conflict, err := ParseConflictPolicy(*conflicts)
+	check(err)
+	s := &Syncer{Client: cl, Verify: keys.Verify, Keys: keys.Current, Attachments: policy, Conflicts: conflict}
+	check(loadJSON(statePath(cursorFile), &s.Cursors))
+	if s.Cursors == nil {
+		s.Cursors = map[upspin.PathName]*Cursor{}
+	}
+
+	for {
+		// reload the states each time as other commands may change them
+		states := ConvStates{}
+		err := loadJSON(statePath(stateFile), &states)
+		var convpaths []upspin.PathName
+		if err == nil {
+			convpaths, err = ListConversations(cl, root)
+		}
+		if err == nil {
+			err = syncConversations(s, states.Active(convpaths), "", hooks, states, *workers)
+			for _, convpath := range states.Active(convpaths) {
+				rules := settings.RetentionFor(path.Base(string(convpath)))
+				if rules.IsZero() {
+					continue
+				}
+				if err := pruneConversation(convpath, rules); err != nil {
+					log.Print(err)
+				}
+			}
+		}
+		if err2 := saveJSON(statePath(cursorFile), s.Cursors); err2 != nil {
+			log.Printf("failed to save sync cursors: %v", err2)
+		}
+		if err != nil {
+			log.Print(err)
+		}
+		time.Sleep(*every)
 	}
+}
+
+// syncTask is the synchronization of one participant's copy of a
+// conversation.
+type syncTask struct {
+	convpath upspin.PathName
+	conv     *Conversation
+	peer     upspin.UserName
+	result   *SyncResult
+	err      error
+}
 
+// syncConversations uses s to copy new files from all participants of each
+// conversation (and the comma-separated users in with) into our copy using up
+// to workers concurrent syncs.  Quarantined files are logged, hooks are run
+// for each newly synchronized message that verifies (unless the conversation
+// is muted in states) and a summary is printed.  A failure to sync from one
+// participant doesn't affect the others.
+func syncConversations(s *Syncer, convpaths []upspin.PathName, with string, hooks []string, states ConvStates, workers int) error {
+	var tasks []*syncTask
 	for _, convpath := range convpaths {
 		conv, err := ReadConversation(cl, convpath)
-		check(err)
+		if err != nil {
+			tasks = append(tasks, &syncTask{convpath: convpath, err: err})
+			continue
+		}
 		if conv.Title() == "" {
 			continue
 		}
+		if _, err := conv.LoadMetadata(cl, keys.Current); err != nil {
+			log.Print(err)
+		}
 
 		// collect all participants in the conversation
 		syncers := map[upspin.UserName]struct{}{}
 		for _, u := range conv.Participants {
 			syncers[u] = struct{}{}
 		}
-		for _, u := range strings.Split(*with, ",") {
+		for _, u := range strings.Split(with, ",") {
 			if u == "" {
 				continue
 			}
 			syncers[upspin.UserName(u)] = struct{}{}
 		}
-
-		// copy all files from *all* participants
 		for u := range syncers {
-			err := Synchronize(cl, ConvPath(u, conv.Title()), convpath)
-			check(err)
-			err = conv.AddParticipant(cfg, u)
-			check(err)
+			if conv.IsAnnouncement() && !conv.Metadata.IsOwner(u) {
+				continue // announcements are only pulled from their owners
+			}
+			tasks = append(tasks, &syncTask{convpath: convpath, conv: conv, peer: u})
+		}
+	}
+
+	// copy all files from *all* participants
+	if workers < 1 {
+		workers = 1
+	}
+	ch := make(chan *syncTask)
+	var wg gosync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range ch {
+				t.result, t.err = s.Sync(ConvPath(t.peer, t.conv.Title()), t.convpath)
+				if t.result != nil {
+					for _, q := range t.result.Quarantined {
+						log.Printf("quarantined %v as %v: %v", q.Src, q.Dst, q.Reason)
+					}
+					if !states.Get(t.convpath).Muted {
+						runHooks(hooks, t.convpath, append(t.result.Copied, t.result.Updated...))
+					}
+				}
+			}
+		}()
+	}
+	for _, t := range tasks {
+		if t.err == nil {
+			ch <- t
+		}
+	}
+	close(ch)
+	wg.Wait()
+
+	failed := 0
+	for _, t := range tasks {
+		if t.err == nil {
+			t.err = t.conv.AddParticipant(cfg, t.peer)
+		}
+		if t.err != nil {
+			failed++
+		}
+	}
+
+	printSyncSummary(tasks)
+	if failed > 0 {
+		return fmt.Errorf("sync failed for %v of %v participant copies", failed, len(tasks))
+	}
+	return nil
+}
+
+// printSyncSummary prints a table of the files fetched from each participant
+// and the participants that failed.
+func printSyncSummary(tasks []*syncTask) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "CONVERSATION\tFROM\tFETCHED\tUPDATED\tDELETED\tQUARANTINED\tSTATUS\n")
+	fetched := 0
+	for _, t := range tasks {
+		status := "ok"
+		if t.err != nil {
+			status = "FAILED: " + t.err.Error()
+		}
+		var n, u, d, q int
+		if t.result != nil {
+			n, u, d, q = len(t.result.Copied), len(t.result.Updated), len(t.result.Deleted), len(t.result.Quarantined)
+		}
+		fetched += n + u
+		if n+u+d+q == 0 && t.err == nil {
+			continue
+		}
+		peer := string(t.peer)
+		if peer == "" {
+			peer = "-"
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", path.Base(string(t.convpath)), peer, n, u, d, q, status)
+	}
+	tw.Flush()
+	fmt.Printf("fetched %v files from %v participant copies\n", fetched, len(tasks))
+}
+
+// runHooks runs each hook for every verified message among the given files.
+// Failures are logged and otherwise ignored.
+func runHooks(hooks []string, convpath upspin.PathName, files []upspin.PathName) {
+	if len(hooks) == 0 {
+		return
+	}
+	for _, p := range files {
+		if !isMsgFile(p) {
+			continue
+		}
+		m, err := ReadMessage(cl, p)
+		if err != nil {
+			log.Printf("hooks skipped for unreadable message %v: %v", p, err)
+			continue
+		} else if err := keys.Verify(m); err != nil {
+			log.Printf("hooks skipped for unverified message %v: %v", p, err)
+			continue
+		}
+		m.Decrypt(cfg)
+		for _, hook := range hooks {
+			if err := RunHook(hook, convpath, m); err != nil {
+				log.Print(err)
+			}
 		}
 	}
 }
 
 func send(fs *flag.FlagSet, cmd string, args []string) {
-	const usage = `[<title> <message>...]`
-	var users = fs.String("to", "", "comma-separated recipient(s) of the message")
+	const usage = `[<title> [<message>...]]`
+	var users = fs.String("to", "", "comma-separated recipient(s) of the message: users, Group files or aliases")
+	var encrypt = fs.Bool("encrypt", false, "encrypt the message to the conversation's current participants")
 	fs.Usage = mkUsage(fs, cmd, usage)
 	fs.Parse(args)
-
-	if 0 < fs.NArg() && fs.NArg() < 2 {
-		log.Println("Need zero or 2+ arguments")
-		fs.Usage()
+	if !isSet(fs, "to") {
+		*users = strings.Join(settings.To, ",")
 	}
 
 	var err error
 	var m *Message
 	var conv *Conversation
+	created := false
 	if fs.NArg() == 0 {
 		m, err = ParseMessage(os.Stdin)
 		check(err)
@@ -164,27 +459,223 @@ func send(fs *flag.FlagSet, cmd string, args []string) {
 		if conv.Title() == "" {
 			err := conv.SetTitle(title)
 			check(err)
+			created = true
+		}
+		text := strings.Join(fs.Args()[1:], " ")
+		if fs.NArg() == 1 {
+			text, err = composeMessage(title)
+			check(err)
 		}
-		m = conv.Add(user, bytes.NewBufferString(strings.Join(fs.Args()[1:], " ")))
+		m = conv.Add(user, bytes.NewBufferString(text))
 	}
 
-	*users = *users + "," + string(user)
-	for _, u := range strings.Split(*users, ",") {
-		if u != "" {
-			if err := conv.AddParticipant(cfg, upspin.UserName(u)); err != nil {
-				log.Printf("failed to add %v to conversation: %v", u, err)
-			}
+	deliver(conv, *users, *encrypt, m)
+	if created {
+		md := NewMetadata(conv, user)
+		if err := WriteMetadata(cl, cfg, conv.Title(), md, participantRoots(conv, md)...); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// deliver adds the comma-separated users, upspin Group files and aliases to
+// the conversation's participants and sends msgs to every participant,
+// encrypting them for the participants first if encrypt is true.
+func deliver(conv *Conversation, users string, encrypt bool, msgs ...*Message) {
+	_, err := conv.LoadMetadata(cl, keys.Current)
+	check(err)
+	if err := conv.CheckPosts(msgs...); err != nil {
+		log.Fatal(err)
+	}
+
+	us, groups, err := settings.Recipients(splitList(users + "," + string(user)))
+	check(err)
+	for _, g := range groups {
+		if err := conv.AddGroup(cfg, g); err != nil {
+			log.Printf("failed to add group %v to conversation: %v", g, err)
+		}
+	}
+	for _, u := range us {
+		if err := conv.AddParticipant(cfg, u); err != nil {
+			log.Printf("failed to add %v to conversation: %v", u, err)
+		}
+	}
+
+	if encrypt {
+		for _, m := range msgs {
+			check(m.Encrypt(cfg, conv.Participants))
+		}
+	}
+
+	if err := conv.Deliver(cl, cfg, msgs...); err != nil {
+		log.Print(err)
+	}
+
+	check(conv.Publish(cl, pageTemplate))
+}
+
+func importMail(fs *flag.FlagSet, cmd string, args []string) {
+	const usage = `<mbox-file|maildir>`
+	var title = fs.String("title", "", "conversation title (default derived from the thread's subject)")
+	var users = fs.String("to", "", "comma-separated participant(s) to deliver the imported messages to")
+	fs.Usage = mkUsage(fs, cmd, usage)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		log.Println("Need exactly 1 argument")
+		fs.Usage()
+	}
+	src := fs.Arg(0)
+
+	var emails []*Email
+	info, err := os.Stat(src)
+	check(err)
+	if info.IsDir() {
+		emails, err = ReadMaildir(src)
+		check(err)
+	} else {
+		f, err := os.Open(src)
+		check(err)
+		emails, err = ReadMbox(f)
+		f.Close()
+		check(err)
+	}
+	if len(emails) == 0 {
+		log.Fatalf("no emails found in '%v'", src)
+	}
+
+	if *title == "" {
+		*title = ThreadTitle(emails)
+	}
+	if *title == "" {
+		log.Fatal("email thread has no subject; use -title")
+	}
+
+	conv, err := ReadConversation(cl, ConvPath(user, *title))
+	check(err)
+	if conv.Title() == "" {
+		check(conv.SetTitle(*title))
+	}
+
+	msgs := conv.Import(user, emails)
+	if len(msgs) == 0 {
+		log.Print("no new emails to import")
+		return
+	}
+	deliver(conv, *users, false, msgs...)
+	log.Printf("imported %v emails into '%v'", len(msgs), *title)
+}
+
+func bridge(fs *flag.FlagSet, cmd string, args []string) {
+	const usage = `[<title>...]`
+	var all = fs.Bool("all", false, "true to bridge all known conversations")
+	var addr = fs.String("email", "", "the bridge's email `address`")
+	var to = fs.String("to", "", "comma-separated email recipients of relayed messages")
+	var smtpAddr = fs.String("smtp", "", "SMTP server `host:port`")
+	var imapAddr = fs.String("imap", "", "IMAP server `host:port`")
+	var mailbox = fs.String("mailbox", "INBOX", "IMAP mailbox to ingest replies from")
+	var login = fs.String("login", "", "mail server login (default the bridge's email address)")
+	var insecure = fs.Bool("insecure", false, "connect to the IMAP server without TLS")
+	var decrypt = fs.Bool("decrypt", false, "mail the decrypted content of encrypted messages instead of a placeholder")
+	var every = fs.Duration("every", 0, "repeat at this interval instead of running once")
+	fs.Usage = mkUsage(fs, cmd, usage)
+	fs.Parse(args)
+
+	if fs.NArg() == 0 && !*all {
+		log.Println("Need title argument(s) or -all")
+		fs.Usage()
+	}
+	if *addr == "" || *smtpAddr == "" || *imapAddr == "" {
+		log.Fatal("-email, -smtp and -imap are required")
+	}
+	if *login == "" {
+		*login = *addr
+	}
+	password := os.Getenv("CONVERSE_MAIL_PASSWORD")
+
+	b := &Bridge{
+		Config:  cfg,
+		Client:  cl,
+		Root:    root,
+		Address: *addr,
+		Decrypt: *decrypt,
+		Mailer:  &SMTPMailer{Addr: *smtpAddr, Username: *login, Password: password},
+		Mailbox: &IMAPMailbox{Addr: *imapAddr, Username: *login, Password: password, Mailbox: *mailbox, Insecure: *insecure},
+	}
+	for _, a := range strings.Split(*to, ",") {
+		if a != "" {
+			b.To = append(b.To, a)
 		}
 	}
 
-	for _, u := range conv.Participants {
-		log.Print("sending to ", u)
-		if err := m.Send(cfg, DefaultRoot(u)); err != nil {
-			log.Printf("send to %v failed", u)
+	statefile := statePath("bridge-" + *addr + ".json")
+	check(loadJSON(statefile, &b.Relayed))
+
+	for {
+		titles := fs.Args()
+		if *all {
+			titles = nil
+			convs, err := ListConversations(cl, root)
+			check(err)
+			for _, conv := range convs {
+				titles = append(titles, path.Base(string(conv)))
+			}
+		}
+
+		err := b.Run(titles)
+		if err2 := saveJSON(statefile, b.Relayed); err2 != nil {
+			log.Printf("failed to save bridge state: %v", err2)
 		}
+		if *every == 0 {
+			check(err)
+			return
+		} else if err != nil {
+			log.Print(err)
+		}
+		time.Sleep(*every)
+	}
+}
+
+func runBot(fs *flag.FlagSet, cmd string, args []string) {
+	const usage = `<bot-name>`
+	every := fs.Duration("every", time.Minute, "interval between checks for new messages")
+	once := fs.Bool("once", false, "handle new messages once and exit")
+	fs.Usage = mkUsage(fs, cmd, usage)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		log.Println("Need exactly 1 argument")
+		fs.Usage()
 	}
 
-	check(conv.Publish(cl))
+	var b *Bot
+	switch name := fs.Arg(0); name {
+	case "standup":
+		b = NewStandupBot(cfg, cl, root)
+	default:
+		log.Fatalf("unknown bot '%v'", name)
+	}
+	b.Verify = keys.Verify
+
+	statefile := statePath("bot-" + fs.Arg(0) + ".json")
+	if _, err := os.Stat(statefile); os.IsNotExist(err) {
+		check(b.MarkSeen())
+	} else {
+		check(loadJSON(statefile, &b.Seen))
+	}
+	for {
+		err := b.Poll()
+		if err2 := saveJSON(statefile, b.Seen); err2 != nil {
+			log.Printf("failed to save bot state: %v", err2)
+		}
+		if *once {
+			check(err)
+			return
+		} else if err != nil {
+			log.Print(err)
+		}
+		time.Sleep(*every)
+	}
 }
 
 func publish(fs *flag.FlagSet, cmd string, args []string) {
@@ -196,15 +687,19 @@ func publish(fs *flag.FlagSet, cmd string, args []string) {
 		log.Println("Need exactly 1 argument")
 		fs.Usage()
 	}
-	title := fs.Arg(0)
-
-	conv, err := ReadConversation(cl, ConvPath(user, title))
+	convpath, err := FindConversation(fs.Arg(0))
 	check(err)
-	check(conv.Publish(cl))
+	conv, err := ReadConversation(cl, convpath)
+	check(err)
+	_, err = conv.LoadMetadata(cl, keys.Current)
+	check(err)
+	check(conv.Publish(cl, pageTemplate))
 }
 
 func list(fs *flag.FlagSet, cmd string, args []string) {
 	const usage = ``
+	tag := fs.String("tag", "", "only list conversations tagged with `tag`")
+	archived := fs.Bool("archived", false, "also list archived conversations")
 	fs.Usage = mkUsage(fs, cmd, usage)
 	fs.Parse(args)
 
@@ -216,10 +711,372 @@ func list(fs *flag.FlagSet, cmd string, args []string) {
 	convs, err := ListConversations(cl, root)
 	check(err)
 
-	preLen := len(root + "/")
+	states := loadStates()
+	for _, conv := range convs {
+		st := states.Get(conv)
+		if st.Deleted || st.Archived && !*archived {
+			continue
+		}
+		md, err := ReadMetadata(cl, conv, keys.Current)
+		if err != nil {
+			log.Print(err)
+		}
+		if *tag != "" && (md == nil || !md.HasTag(*tag)) {
+			continue
+		}
+		id := path.Base(string(conv))
+		name := id
+		if md != nil && md.Name != "" && md.Name != id {
+			name = fmt.Sprintf("%v (%v)", md.Name, id)
+		}
+		if st.Archived {
+			name += " [archived]"
+		} else if st.Muted {
+			name += " [muted]"
+		}
+		fmt.Println(name)
+	}
+}
+
+// FindConversation returns the path of our conversation whose title (its
+// stable ID) or, failing that, current display name is name.
+func FindConversation(name string) (upspin.PathName, error) {
+	convpath := ConvPath(user, name)
+	if _, err := cl.Lookup(convpath, true); err == nil {
+		return convpath, nil
+	}
+
+	convs, err := ListConversations(cl, root)
+	if err != nil {
+		return "", err
+	}
 	for _, conv := range convs {
-		fmt.Println(conv[preLen:])
+		if md, err := ReadMetadata(cl, conv, keys.Current); err == nil && md != nil && md.Name == name {
+			return conv, nil
+		}
+	}
+	return "", fmt.Errorf("no conversation named '%v'", name)
+}
+
+func meta(fs *flag.FlagSet, cmd string, args []string) {
+	const usage = `<conversation-name>`
+	desc := fs.String("description", "", "set the conversation's description")
+	tags := fs.String("tags", "", "set the conversation's comma-separated tags")
+	modes := fs.String("modes", "", "set the conversation's comma-separated modes: pull-only, announce-only")
+	owners := fs.String("owners", "", "set the comma-separated `users` besides its creator who own the conversation")
+	fs.Usage = mkUsage(fs, cmd, usage)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		log.Println("Wrong number of arguments")
+		fs.Usage()
+	}
+
+	convpath, err := FindConversation(fs.Arg(0))
+	check(err)
+	conv, err := ReadConversation(cl, convpath)
+	check(err)
+	md, err := conv.LoadMetadata(cl, keys.Current)
+	check(err)
+	if md == nil {
+		md = NewMetadata(conv, user)
+	}
+	if !isSet(fs, "description") && !isSet(fs, "tags") && !isSet(fs, "modes") && !isSet(fs, "owners") {
+		fmt.Print(md)
+		return
+	}
+
+	if isSet(fs, "description") {
+		md.Description = *desc
+	}
+	if isSet(fs, "tags") {
+		md.Tags = splitList(*tags)
+	}
+	governance := isSet(fs, "modes") || isSet(fs, "owners")
+	if governance && !md.IsOwner(user) {
+		log.Fatalf("only owners of '%v' may change its modes and owners", conv.DisplayName())
+	}
+	if isSet(fs, "modes") {
+		check(md.SetModes(splitList(*modes)))
+	}
+	if isSet(fs, "owners") {
+		md.Owners = nil
+		for _, u := range splitList(*owners) {
+			md.Owners = append(md.Owners, upspin.UserName(u))
+		}
+	}
+	check(WriteMetadata(cl, cfg, path.Base(string(conv.Location)), md, participantRoots(conv, md)...))
+	if governance {
+		conv.Metadata = md
+		check(conv.RefreshRights(cfg))
+	}
+}
+
+func archive(fs *flag.FlagSet, cmd string, args []string) {
+	updateStates(fs, cmd, args, func(st *ConvState) { st.Archived = true })
+}
+
+func unarchive(fs *flag.FlagSet, cmd string, args []string) {
+	// also undoes delete, letting "sync <title>" fetch the conversation again
+	updateStates(fs, cmd, args, func(st *ConvState) { st.Archived, st.Deleted = false, false })
+}
+
+func mute(fs *flag.FlagSet, cmd string, args []string) {
+	off := fs.Bool("off", false, "unmute the conversations")
+	updateStates(fs, cmd, args, func(st *ConvState) { st.Muted = !*off })
+}
+
+// updateStates applies change to the local state of each conversation named
+// in args.  Conversations whose copy was deleted are found by their title in
+// the local state.
+func updateStates(fs *flag.FlagSet, cmd string, args []string, change func(*ConvState)) {
+	const usage = `<conversation-name>...`
+	fs.Usage = mkUsage(fs, cmd, usage)
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		log.Println("Need at least one conversation")
+		fs.Usage()
+	}
+
+	states := loadStates()
+	for _, name := range fs.Args() {
+		convpath, err := FindConversation(name)
+		if _, ok := states[ConvPath(user, name)]; err != nil && ok {
+			convpath, err = ConvPath(user, name), nil
+		}
+		check(err)
+		st := states.Get(convpath)
+		change(&st)
+		states.Set(convpath, st)
+	}
+	check(saveJSON(statePath(stateFile), states))
+}
+
+func deleteConv(fs *flag.FlagSet, cmd string, args []string) {
+	const usage = `<conversation-name>`
+	withAccess := fs.Bool("access", false, "also revoke participants' access to our copy in our Access file")
+	fs.Usage = mkUsage(fs, cmd, usage)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		log.Println("Wrong number of arguments")
+		fs.Usage()
+	}
+
+	convpath, err := FindConversation(fs.Arg(0))
+	check(err)
+	check(RemoveAll(cl, convpath, true))
+	if *withAccess {
+		check(RevokeAccess(cl, convpath, user))
+	}
+
+	// forget the cursors so the conversation is fetched in full if it is
+	// ever unarchived
+	var cursors map[upspin.PathName]*Cursor
+	check(loadJSON(statePath(cursorFile), &cursors))
+	for src := range cursors {
+		if path.Base(string(src)) == path.Base(string(convpath)) {
+			delete(cursors, src)
+		}
+	}
+	check(saveJSON(statePath(cursorFile), cursors))
+
+	states := loadStates()
+	states.Set(convpath, ConvState{Deleted: true})
+	check(saveJSON(statePath(stateFile), states))
+}
+
+// changeRole moves a participant step places through the roles, from owner
+// to reader, or to the role given with -to.
+func changeRole(fs *flag.FlagSet, cmd string, args []string, step int) {
+	const usage = `<conversation-name> <user>`
+	to := fs.String("to", "", "the `role` to give: owner, moderator, member or reader")
+	fs.Usage = mkUsage(fs, cmd, usage)
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		log.Println("Wrong number of arguments")
+		fs.Usage()
+	}
+	u := upspin.UserName(fs.Arg(1))
+
+	convpath, err := FindConversation(fs.Arg(0))
+	check(err)
+	conv, err := ReadConversation(cl, convpath)
+	check(err)
+	md, err := conv.LoadMetadata(cl, keys.Current)
+	check(err)
+	if md == nil {
+		md = NewMetadata(conv, user)
+	}
+	if !md.IsOwner(user) {
+		log.Fatalf("only owners of '%v' may change roles", conv.DisplayName())
+	}
+
+	role := *to
+	if role == "" {
+		i := 0
+		for i < len(knownRoles) && knownRoles[i] != md.RoleOf(u) {
+			i++
+		}
+		if i+step < 0 || i+step >= len(knownRoles) {
+			log.Fatalf("%v is already a %v", u, md.RoleOf(u))
+		}
+		role = knownRoles[i+step]
+	}
+	check(md.SetRole(u, role))
+	check(WriteMetadata(cl, cfg, path.Base(string(conv.Location)), md, participantRoots(conv, md)...))
+
+	conv.Metadata = md
+	check(conv.SetRights(cfg, u))
+	fmt.Printf("%v is now a %v of '%v'\n", u, role, conv.DisplayName())
+}
+
+func hide(fs *flag.FlagSet, cmd string, args []string) {
+	const usage = `<conversation-name> <message>`
+	fs.Usage = mkUsage(fs, cmd, usage)
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		log.Println("Wrong number of arguments")
+		fs.Usage()
+	}
+
+	convpath, err := FindConversation(fs.Arg(0))
+	check(err)
+	conv, err := ReadConversation(cl, convpath)
+	check(err)
+	_, err = conv.LoadMetadata(cl, keys.Current)
+	check(err)
+	m, err := conv.Hide(user, MsgName(path.Base(fs.Arg(1))))
+	check(err)
+	deliver(conv, "", false, m)
+}
+
+func subscribe(fs *flag.FlagSet, cmd string, args []string) {
+	const usage = `<owner> <title>`
+	fs.Usage = mkUsage(fs, cmd, usage)
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		log.Println("Wrong number of arguments")
+		fs.Usage()
 	}
+	owner, title := upspin.UserName(fs.Arg(0)), fs.Arg(1)
+
+	// creates our copy of the conversation
+	conv, err := ReadConversation(cl, ConvPath(user, title))
+	check(err)
+
+	s := &Syncer{Client: cl, Verify: keys.Verify, Keys: keys.Current}
+	r, err := s.Sync(ConvPath(owner, title), conv.Location)
+	check(err)
+	for _, q := range r.Quarantined {
+		log.Printf("quarantined %v as %v: %v", q.Src, q.Dst, q.Reason)
+	}
+	fmt.Printf("fetched %v files from %v; sync to pull new posts\n", len(r.Copied), owner)
+}
+
+func prune(fs *flag.FlagSet, cmd string, args []string) {
+	const usage = `<conversation-name>...`
+	all := fs.Bool("all", false, "prune all conversations that aren't archived")
+	maxAge := fs.Duration("maxage", 0, "prune messages older than `age` (overrides settings)")
+	maxCount := fs.Int("maxcount", 0, "keep only the `n` most recent messages (overrides settings)")
+	maxAttach := fs.Int64("maxattachment", 0, "prune attachments larger than `bytes` (overrides settings)")
+	fs.Usage = mkUsage(fs, cmd, usage)
+	fs.Parse(args)
+
+	if fs.NArg() == 0 && !*all {
+		log.Println("Need at least one conversation")
+		fs.Usage()
+	}
+
+	var convpaths []upspin.PathName
+	if *all {
+		pths, err := ListConversations(cl, root)
+		check(err)
+		convpaths = loadStates().Active(pths)
+	}
+	for _, name := range fs.Args() {
+		convpath, err := FindConversation(name)
+		check(err)
+		convpaths = append(convpaths, convpath)
+	}
+
+	override := Retention{MaxAge: *maxAge, MaxCount: *maxCount, MaxAttachment: *maxAttach}
+	for _, convpath := range convpaths {
+		rules := settings.RetentionFor(path.Base(string(convpath))).Override(override)
+		if rules.IsZero() {
+			log.Printf("no retention rules for %v", convpath)
+			continue
+		}
+		check(pruneConversation(convpath, rules))
+	}
+}
+
+// pruneConversation prunes the conversation at convpath according to rules
+// and republishes it if anything was pruned.
+func pruneConversation(convpath upspin.PathName, rules Retention) error {
+	pruned, err := Prune(cl, cfg, convpath, rules, time.Now())
+	for _, rel := range pruned {
+		fmt.Printf("%v: pruned %v\n", path.Base(string(convpath)), rel)
+	}
+	if err != nil || len(pruned) == 0 {
+		return err
+	}
+
+	conv, err := ReadConversation(cl, convpath)
+	if err != nil {
+		return err
+	}
+	if _, err := conv.LoadMetadata(cl, keys.Current); err != nil {
+		return err
+	}
+	return conv.Publish(cl, pageTemplate)
+}
+
+// loadStates loads the local conversation states.
+func loadStates() ConvStates {
+	states := ConvStates{}
+	check(loadJSON(statePath(stateFile), &states))
+	return states
+}
+
+func rename(fs *flag.FlagSet, cmd string, args []string) {
+	const usage = `<conversation-name> <new-name>`
+	fs.Usage = mkUsage(fs, cmd, usage)
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		log.Println("Wrong number of arguments")
+		fs.Usage()
+	}
+	name := strings.TrimSpace(fs.Arg(1))
+	if name == "" {
+		log.Fatal("new name must not be empty")
+	}
+
+	convpath, err := FindConversation(fs.Arg(0))
+	check(err)
+	conv, err := ReadConversation(cl, convpath)
+	check(err)
+	md, err := conv.LoadMetadata(cl, keys.Current)
+	check(err)
+	if md == nil {
+		md = NewMetadata(conv, user)
+	}
+
+	// The rename is recorded in our signed metadata; the directory and the
+	// messages keep the original title so their signatures still verify.
+	md.Name = name
+	title := path.Base(string(conv.Location))
+	if name == title {
+		md.Name = ""
+	}
+	check(WriteMetadata(cl, cfg, title, md, participantRoots(conv, md)...))
+	conv.Name = md.Name
+	check(conv.Publish(cl, pageTemplate))
 }
 
 func create(fs *flag.FlagSet, cmd string, args []string) {
@@ -259,18 +1116,29 @@ func show(fs *flag.FlagSet, cmd string, args []string) {
 	fs.Usage = mkUsage(fs, cmd, usage)
 	var dohtml = fs.Bool("html", false, "render conversation messages as html")
 	fs.Parse(args)
+	if !isSet(fs, "html") {
+		*dohtml = settings.Format == "html"
+	}
 
 	if fs.NArg() != 1 {
 		log.Println("Wrong number of arguments")
 		fs.Usage()
 	}
 
-	conv, err := ReadConversation(cl, ConvPath(user, fs.Arg(0)))
+	convpath, err := FindConversation(fs.Arg(0))
+	check(err)
+	conv, err := ReadConversation(cl, convpath)
+	check(err)
+	_, err = conv.LoadMetadata(cl, keys.Current)
 	check(err)
+	conv.Decrypt(cfg)
 
 	if *dohtml {
-		fmt.Printf("%s", conv.RenderHtml())
+		html, err := conv.Html(pageTemplate)
+		check(err)
+		fmt.Printf("%s", html)
 	} else {
+		fmt.Printf("%v\n\n", conv.DisplayName())
 		fmt.Print(conv)
 	}
 }
@@ -315,9 +1183,12 @@ func download(fs *flag.FlagSet, cmd string, args []string) {
 
 	conv, err := ReadConversation(cl, ConvPath(user, title))
 	check(err)
+	conv.Decrypt(cfg)
 
 	html := filepath.Join(title, "index.html")
-	err = ioutil.WriteFile(html, conv.RenderHtml(), 0644)
+	data, err := conv.Html(pageTemplate)
+	check(err)
+	err = ioutil.WriteFile(html, data, 0644)
 	check(err)
 
 	if *open {
@@ -338,39 +1209,322 @@ func addfile(fs *flag.FlagSet, cmd string, args []string) {
 		fs.Usage()
 	}
 
-	title := fs.Arg(0)
+	convpath, err := FindConversation(fs.Arg(0))
+	check(err)
 	for _, fname := range fs.Args()[1:] {
 		func() {
 			f, err := os.Open(fname)
 			check(err)
 			defer f.Close()
-			err = AddFile(cl, Join(ConvPath(user, title), filepath.Base(fname)), f)
+			err = AddFile(cl, Join(convpath, filepath.Base(fname)), f)
 			check(err)
 		}()
 	}
 }
 
+func retract(fs *flag.FlagSet, cmd string, args []string) {
+	const usage = `<conversation-name> <message>`
+	fs.Usage = mkUsage(fs, cmd, usage)
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		log.Println("Wrong number of arguments")
+		fs.Usage()
+	}
+
+	convpath, err := FindConversation(fs.Arg(0))
+	check(err)
+	conv, err := ReadConversation(cl, convpath)
+	check(err)
+	target := MsgName(path.Base(fs.Arg(1)))
+	m, err := conv.Retract(user, target)
+	check(err)
+	deliver(conv, "", false, m)
+
+	// remove our copy; the tombstone propagates the removal on sync
+	if err := Remove(cl, cfg, conv.Location, string(target)); err != nil {
+		log.Printf("failed to remove our copy of %v: %v", target, err)
+	}
+}
+
+func migrate(fs *flag.FlagSet, cmd string, args []string) {
+	const usage = `[<title>...]`
+	all := fs.Bool("all", false, "true to migrate all known conversations")
+	fs.Usage = mkUsage(fs, cmd, usage)
+	fs.Parse(args)
+
+	if fs.NArg() == 0 && !*all {
+		log.Println("Need title argument")
+		fs.Usage()
+	}
+
+	convpaths := []upspin.PathName{}
+	if *all {
+		pths, err := ListConversations(cl, root)
+		check(err)
+		convpaths = append(convpaths, pths...)
+	}
+	for _, name := range fs.Args() {
+		convpath, err := FindConversation(name)
+		check(err)
+		convpaths = append(convpaths, convpath)
+	}
+
+	for _, convpath := range convpaths {
+		conv, err := ReadConversation(cl, convpath)
+		check(err)
+		migrated, kept, err := conv.Migrate(cl, cfg)
+		for _, name := range migrated {
+			fmt.Printf("%v: migrated %v to version %v\n", conv.Title(), name, msgVersion)
+		}
+		for _, name := range kept {
+			fmt.Printf("%v: kept %v (only %v can migrate it)\n", conv.Title(), name, name.User())
+		}
+		check(err)
+	}
+}
+
 func verify(fs *flag.FlagSet, cmd string, args []string) {
 	const usage = `<conversation-name>`
+	stdin := fs.Bool("stdin", false, "verify a message payload read from standard input instead of a conversation")
+	trusted := fs.String("keys", "", "`file` of trusted public keys to verify against instead of the key server")
 	fs.Usage = mkUsage(fs, cmd, usage)
 	err := fs.Parse(args)
 
+	if *stdin {
+		verifyPayloads([]string{"-"}, *trusted)
+		return
+	} else if fs.NArg() != 1 {
+		log.Println("Wrong number of arguments")
+		fs.Usage()
+	}
+
+	convpath, err := FindConversation(fs.Arg(0))
+	check(err)
+	conv, err := ReadConversation(cl, convpath)
+	check(err)
+
+	report := VerifyConversation(conv, trustedVerifier(*trusted), time.Now())
+	report.Print(os.Stdout)
+	if report.Failed() {
+		os.Exit(1)
+	}
+}
+
+func export(fs *flag.FlagSet, cmd string, args []string) {
+	const usage = `<conversation-name>`
+	out := fs.String("o", "", "output `file` (default <conversation-name>.tar)")
+	fs.Usage = mkUsage(fs, cmd, usage)
+	fs.Parse(args)
+
 	if fs.NArg() != 1 {
 		log.Println("Wrong number of arguments")
 		fs.Usage()
 	}
 
-	conv, err := ReadConversation(cl, ConvPath(user, fs.Arg(0)))
+	convpath, err := FindConversation(fs.Arg(0))
+	check(err)
+	if *out == "" {
+		*out = fs.Arg(0) + ".tar"
+	}
+	f, err := os.Create(*out)
 	check(err)
+	err = WriteArchive(f, cl, cfg, convpath, keys.Current)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	check(err)
+}
 
-	for _, msg := range conv.Messages {
-		err := msg.Verify(cfg)
-		if err != nil {
-			log.Printf("'%v' FAILED verification", msg.Name())
-		} else {
-			fmt.Printf("'%v' verified\n", msg.Name())
-		}
+func restore(fs *flag.FlagSet, cmd string, args []string) {
+	const usage = `<archive-file>`
+	into := fs.String("into", "", "upspin `root` directory to restore into (default the conversations root)")
+	local := fs.String("local", "", "local `directory` to restore into instead of upspin")
+	withAccess := fs.Bool("access", false, "restore the archived Access file")
+	force := fs.Bool("force", false, "restore even if messages fail verification")
+	trusted := fs.String("keys", "", "`file` of trusted public keys to verify against instead of the key server")
+	fs.Usage = mkUsage(fs, cmd, usage)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		log.Println("Wrong number of arguments")
+		fs.Usage()
+	}
+	if *local == "" || *trusted == "" {
+		loadConfig(*configPath)
 	}
+
+	f, err := os.Open(fs.Arg(0))
+	check(err)
+	defer f.Close()
+	a, err := ReadArchive(f)
+	check(err)
+	key, err := trustedKey(*trusted, a.Manifest.Creator)
+	check(err)
+	report, err := a.Verify(key)
+	check(err)
+	report.Print(os.Stdout)
+	if report.Failed() && !*force {
+		log.Fatal("archived messages failed verification; use -force to restore anyway")
+	}
+
+	if *local != "" {
+		check(a.RestoreLocal(*local))
+		return
+	}
+	dst := root
+	if *into != "" {
+		dst = upspin.PathName(*into)
+	}
+	check(a.Restore(cl, dst, *withAccess))
+}
+
+func verifyFile(fs *flag.FlagSet, cmd string, args []string) {
+	const usage = `[<file>...]`
+	trusted := fs.String("keys", "", "`file` of trusted public keys to verify against instead of the key server")
+	fs.Usage = mkUsage(fs, cmd, usage)
+	fs.Parse(args)
+
+	if *trusted == "" {
+		loadConfig(*configPath)
+	}
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	verifyPayloads(files, *trusted)
+}
+
+// verifyPayloads verifies the message payloads and archive bundles (files
+// ending in ".tar") in the given local files ("-" for standard input) using
+// the trusted keys file if given, printing a report and exiting with status 1
+// if any fail.
+func verifyPayloads(files []string, trusted string) {
+	verify := trustedVerifier(trusted)
+	report := &Report{}
+	for _, fname := range files {
+		func() {
+			f := os.Stdin
+			if fname != "-" {
+				var err error
+				f, err = os.Open(fname)
+				check(err)
+				defer f.Close()
+			}
+			if !strings.HasSuffix(fname, ".tar") {
+				report.Messages = append(report.Messages, VerifyPayload(fname, f, verify, time.Now()))
+				return
+			}
+
+			r, err := verifyArchive(f, trusted)
+			if err != nil {
+				report.Messages = append(report.Messages, &MsgReport{Name: MsgName(fname), Signature: "FAILED", Errors: []string{err.Error()}})
+				return
+			}
+			report.Messages = append(report.Messages, r.Messages...)
+		}()
+	}
+	report.Print(os.Stdout)
+	if report.Failed() {
+		os.Exit(1)
+	}
+}
+
+// verifyArchive reads and verifies an archive bundle using the trusted keys
+// file if given.
+func verifyArchive(r io.Reader, trusted string) (*Report, error) {
+	a, err := ReadArchive(r)
+	if err != nil {
+		return nil, err
+	}
+	key, err := trustedKey(trusted, a.Manifest.Creator)
+	if err != nil {
+		return nil, err
+	}
+	return a.Verify(key)
+}
+
+// trustedKey returns u's public key from the local trusted keys file fname
+// or, if fname is empty, the cached key server keys.
+func trustedKey(fname string, u upspin.UserName) (upspin.PublicKey, error) {
+	if fname == "" {
+		return keys.Current(u)
+	}
+	tk, err := LoadTrustedKeys(os.ExpandEnv(fname))
+	if err != nil {
+		return "", err
+	} else if key, ok := tk[u]; ok {
+		return key, nil
+	}
+	return "", fmt.Errorf("no trusted key for %v", u)
+}
+
+// trustedVerifier returns a function verifying messages against the keys in
+// the local file fname or, if fname is empty, the cached key server keys.
+func trustedVerifier(fname string) func(*Message) error {
+	if fname == "" {
+		return keys.Verify
+	}
+	tk, err := LoadTrustedKeys(os.ExpandEnv(fname))
+	check(err)
+	return tk.Verify
+}
+
+// loadSettings reads the converse settings file and applies settings for
+// global flags that weren't given on the command line.
+func loadSettings(path string) {
+	var err error
+	settings, err = LoadSettings(os.ExpandEnv(path))
+	check(err)
+
+	if !isSet(flag.CommandLine, "root") && settings.Root != "" {
+		*rootdir = settings.Root
+	}
+	if !isSet(flag.CommandLine, "state") && settings.StateDir != "" {
+		*statedir = settings.StateDir
+	}
+	if !isSet(flag.CommandLine, "template") {
+		*templatePath = settings.Template
+	}
+	if *templatePath != "" {
+		pageTemplate, err = template.ParseFiles(os.ExpandEnv(*templatePath))
+		check(err)
+	}
+}
+
+// composeMessage opens the configured editor (or $EDITOR) to compose a new
+// message for the titled conversation and returns the text written.
+func composeMessage(title string) (string, error) {
+	editor := settings.Editor
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	f, err := ioutil.TempFile("", "converse-msg")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	cmd := exec.Command("sh", "-c", editor+` "$0"`, f.Name())
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("editor failed: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return "", err
+	}
+	text := strings.TrimSpace(string(data))
+	if text == "" {
+		return "", fmt.Errorf("empty message for '%v' not sent", title)
+	}
+	return text, nil
 }
 
 func loadConfig(path string) {
@@ -392,10 +1546,21 @@ func loadConfig(path string) {
 
 	root = Join(upspin.PathName(user), *rootdir)
 
+	keys, err = OpenKeyCache(statePath("keys.json"), *keyTTL, func(u upspin.UserName) (upspin.PublicKey, error) {
+		return lookup(cfg, u)
+	})
+	check(err)
+	ConversationKeys = keys.Current
+
 	transports.Init(cfg)
 	cacheutil.Start(cfg)
 }
 
+// statePath returns the path of the named file in the local state directory.
+func statePath(name string) string {
+	return filepath.Join(os.ExpandEnv(*statedir), name)
+}
+
 func mkUsage(fs *flag.FlagSet, cmd, usage string) func() {
 	return func() {
 		log.Printf("Usage:\n   converse %v %v\nOptions:\n", cmd, usage)
@@ -403,6 +1568,27 @@ func mkUsage(fs *flag.FlagSet, cmd, usage string) func() {
 	}
 }
 
+// stringList is a flag.Value collecting the values of a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// isSet reports whether the named flag was given on the command line.
+func isSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 func check(err error) {
 	if err != nil {
 		log.Fatal(err)
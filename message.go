@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/sha256"
 	"encoding/json"
@@ -23,6 +24,23 @@ const (
 	msgExtension = "txt"
 )
 
+// msgVersion is the format version of new messages.  Messages written before
+// the format was versioned carry no version and are version 1.
+const msgVersion = 5
+
+const (
+	// maxMsgSize limits the size of a message file.
+	maxMsgSize = 4 << 20
+	// maxHeaderSize limits the size of a message's header.
+	maxHeaderSize = 64 << 10
+)
+
+const (
+	retractedPlaceholder = "*[message retracted by author]*"
+	hiddenPlaceholder    = "*[message hidden by a moderator]*"
+	rejectedPlaceholder  = "*[message from a participant not permitted to post]*"
+)
+
 const (
 	msgSigHeader    = "\n\n-------------------------- SIGNATURE ---------------------------"
 	msgHeaderMarker = "-------------------------- END HEADER --------------------------\n\n"
@@ -35,10 +53,39 @@ func NewMsgName(user upspin.UserName, num int) MsgName {
 	return MsgName(fmt.Sprintf("%v%v-%v.%v", msgPrefix, num, user, msgExtension))
 }
 
-func ParseMsgName(name string) MsgName {
+// ParseMsgName checks that name is a well formed message name.
+func ParseMsgName(name string) (MsgName, error) {
 	mn := MsgName(name)
-	mn.Number()
-	return mn
+	if _, _, err := mn.parse(); err != nil {
+		return "", err
+	}
+	return mn, nil
+}
+
+// parse splits the name into its number and user.  Numbers must be positive
+// and written without sign or leading zeros so that every message has a
+// single name.  Revisions replace a message's file rather than adding
+// numbered revision names (see notes.md), so those are rejected.
+func (n MsgName) parse() (int, upspin.UserName, error) {
+	s := string(n)
+	if !strings.HasPrefix(s, msgPrefix) || !strings.HasSuffix(s, "."+msgExtension) {
+		return 0, "", fmt.Errorf("invalid message name '%v'", n)
+	}
+	s = s[len(msgPrefix) : len(s)-len(msgExtension)-1]
+	i := strings.Index(s, "-")
+	if i < 1 || i == len(s)-1 || s[0] == '0' {
+		return 0, "", fmt.Errorf("invalid message name '%v'", n)
+	}
+	for _, c := range s[:i] {
+		if c < '0' || c > '9' {
+			return 0, "", fmt.Errorf("invalid message name '%v'", n)
+		}
+	}
+	num, err := strconv.Atoi(s[:i])
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid message name '%v'", n)
+	}
+	return num, upspin.UserName(s[i+1:]), nil
 }
 
 func (n MsgName) NextName(user upspin.UserName) MsgName {
@@ -48,41 +95,81 @@ func (n MsgName) NextName(user upspin.UserName) MsgName {
 	return NewMsgName(user, n.Number()+1)
 }
 
+// User returns the user who wrote the named message or "" if the name is
+// malformed.
 func (n MsgName) User() upspin.UserName {
-	user := n[strings.Index(string(n), "-")+1 : strings.LastIndex(string(n), ".")]
-	return upspin.UserName(user)
+	_, user, _ := n.parse()
+	return user
 }
 
+// Number returns the message's number or 0 if the name is malformed.
 func (n MsgName) Number() int {
-	i := strings.Index(string(n), ".")
-	i2 := strings.Index(string(n), "-")
-	if i2 < i {
-		i = i2
-	}
-	if i < 0 {
-		panic("invalid message name '" + n + "'")
-	}
-	numStr := n[len(msgPrefix):i]
-	num, err := strconv.Atoi(string(numStr))
-	if err != nil {
-		panic("invalid message name '" + n + "'")
-	}
+	num, _, _ := n.parse()
 	return num
 }
 
+// Origin records where a message came from when it was relayed into a
+// conversation by someone other than its original author (e.g. imported from
+// an email thread).  The relaying user is the message's Author and signer.
+type Origin struct {
+	// Source names the medium the message was relayed from (e.g. "email").
+	Source string
+	// From identifies the original author within Source.
+	From      string
+	MessageID string `json:",omitempty"`
+	InReplyTo string `json:",omitempty"`
+}
+
+// OriginalSig holds the signature of a message from before it was migrated
+// to a newer format version by its author.
+type OriginalSig struct {
+	Version int
+	// R and S are hex encoded.
+	R, S string
+}
+
 type Message struct {
-	Author upspin.UserName
+	// Version is the message's format version (0 for version 1 messages).
+	Version int `json:",omitempty"`
+	Author  upspin.UserName
 	// Title represents the name of this message's conversation
-	Title   string
-	Time    time.Time
-	Parent  MsgName `json:"ParentMessage"`
-	Body    io.Reader
-	content string
-	sig     upspin.Signature
+	Title  string
+	Time   time.Time
+	Parent MsgName `json:"ParentMessage"`
+	// Origin is non-nil for messages relayed on behalf of someone else.
+	Origin *Origin
+	// Encryption is non-nil for messages with encrypted content.
+	Encryption *Encryption
+	// Retracts names the author's earlier message that this message
+	// retracts, if any.
+	Retracts MsgName `json:",omitempty"`
+	// Hides names a message that this message, by a moderator or owner,
+	// hides from the conversation, if any.  Only version 5 and later
+	// messages sign it, so it is ignored in older ones.
+	Hides MsgName `json:",omitempty"`
+	// Original is non-nil for messages migrated from an older format
+	// version.
+	Original *OriginalSig `json:",omitempty"`
+	Body     io.Reader
+	content  string
+	sig      upspin.Signature
+	// file is the path the message was read from, if any.
+	file upspin.PathName
+	// plain holds the decrypted content of encrypted messages.
+	plain     string
+	decrypted bool
+	// retracted is set for messages retracted by their author.
+	retracted bool
+	// pruned is set for placeholders of messages removed by a retention
+	// policy.
+	pruned bool
+	// hidden is set for messages hidden by a moderator and rejected for
+	// messages whose author's role doesn't permit posting.
+	hidden, rejected bool
 }
 
 func NewMessage(author upspin.UserName, title string, parent MsgName, body io.Reader) *Message {
-	return &Message{Author: author, Title: title, Parent: parent, Body: body, Time: time.Now()}
+	return &Message{Version: msgVersion, Author: author, Title: title, Parent: parent, Body: body, Time: time.Now()}
 }
 
 func ReadMessage(cl upspin.Client, path upspin.PathName) (*Message, error) {
@@ -91,85 +178,264 @@ func ReadMessage(cl upspin.Client, path upspin.PathName) (*Message, error) {
 		return nil, err
 	}
 	defer f.Close()
-	return ParseMessage(f)
+	m, err := ParseMessage(f)
+	if err != nil {
+		return nil, err
+	}
+	m.file = path
+	return m, nil
 }
 
+// ParseMessage parses a message of any supported format version.  Messages
+// larger than maxMsgSize are rejected.
 func ParseMessage(r io.Reader) (*Message, error) {
-	data, err := ioutil.ReadAll(r)
+	lr := &io.LimitedReader{R: r, N: maxMsgSize + 1}
+	br := bufio.NewReader(lr)
+
+	header, err := readHeader(br)
 	if err != nil {
 		return nil, err
 	}
-	s := string(data)
 
-	// parse/separate header, body, footer
-	i := strings.Index(s, msgHeaderMarker)
-	if i < 0 {
-		return nil, errors.New("failed to find header while parsing message")
+	var h struct {
+		Version int
+		Length  int64
 	}
-
-	j := strings.LastIndex(s, msgSigHeader)
-	if j < 0 {
-		return nil, errors.New("failed to find signature while parsing message")
+	if err := json.Unmarshal([]byte(header), &h); err != nil {
+		return nil, errors.New("malformed message header: " + err.Error())
 	}
 
-	header := s[:i]
-	footer := s[j+len(msgSigHeader):]
-	content := s[i+len(msgHeaderMarker) : j]
-
-	m := &Message{content: content}
+	var content, footer []byte
+	switch h.Version {
+	case 0, 1, 2:
+		// version 2 only adds the Version and Original header fields.  The
+		// content of these versions extends to the last signature header.
+		rest, err := ioutil.ReadAll(br)
+		if err != nil {
+			return nil, err
+		}
+		j := bytes.LastIndex(rest, []byte(msgSigHeader))
+		if j < 0 {
+			return nil, errors.New("failed to find signature while parsing message")
+		}
+		content, footer = rest[:j], rest[j:]
+	case 3, 4, 5:
+		// versions 4 and 5 only change the signed bytes
+		if h.Length < 0 || h.Length > maxMsgSize {
+			return nil, fmt.Errorf("invalid content length %v", h.Length)
+		}
+		content = make([]byte, h.Length)
+		if _, err := io.ReadFull(br, content); err != nil {
+			return nil, errors.New("message content shorter than its length")
+		}
+		if footer, err = ioutil.ReadAll(br); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported message format version %v", h.Version)
+	}
+	if lr.N == 0 {
+		return nil, fmt.Errorf("message exceeds %v bytes", maxMsgSize)
+	}
 
-	// parse header
-	err = json.Unmarshal([]byte(header), &m)
-	if err != nil {
+	m := &Message{content: string(content)}
+	if err := json.Unmarshal([]byte(header), m); err != nil {
 		return nil, errors.New("malformed message header: " + err.Error())
 	}
+	if m.Parent != "" {
+		if _, err := ParseMsgName(string(m.Parent)); err != nil {
+			return nil, fmt.Errorf("malformed parent: %v", err)
+		}
+	}
+	if m.Retracts != "" {
+		if _, err := ParseMsgName(string(m.Retracts)); err != nil {
+			return nil, fmt.Errorf("malformed retraction: %v", err)
+		}
+	}
+	if m.Hides != "" {
+		if _, err := ParseMsgName(string(m.Hides)); err != nil {
+			return nil, fmt.Errorf("malformed hide: %v", err)
+		}
+	}
 
 	// parse crypto signature
-	sigText := strings.TrimSpace(footer)
+	if !bytes.HasPrefix(footer, []byte(msgSigHeader)) {
+		return nil, errors.New("failed to find signature while parsing message")
+	}
+	sigText := strings.TrimSpace(string(footer[len(msgSigHeader):]))
 	parts := strings.Split(sigText, "\n")
 	if len(parts) != 2 {
 		return nil, errors.New("found malformed signature while parsing message")
 	}
-	rs, ss := parts[0], parts[1]
+	m.sig, err = parseSig(parts[0], parts[1])
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// readHeader reads the message header up to and excluding msgHeaderMarker.
+func readHeader(br *bufio.Reader) (string, error) {
+	var buf bytes.Buffer
+	for !bytes.HasSuffix(buf.Bytes(), []byte(msgHeaderMarker)) {
+		line, err := br.ReadSlice('\n')
+		buf.Write(line)
+		if buf.Len() > maxHeaderSize {
+			return "", fmt.Errorf("message header exceeds %v bytes", maxHeaderSize)
+		} else if err == io.EOF {
+			return "", errors.New("failed to find header while parsing message")
+		} else if err != nil && err != bufio.ErrBufferFull {
+			return "", err
+		}
+	}
+	return buf.String()[:buf.Len()-len(msgHeaderMarker)], nil
+}
 
-	rint, sint := new(big.Int), new(big.Int)
-	rint, success := rint.SetString(rs, sigBase)
+// parseSig parses the hex encoded R and S of a signature.
+func parseSig(rs, ss string) (upspin.Signature, error) {
+	rint, success := new(big.Int).SetString(rs, sigBase)
 	if !success {
-		return nil, errors.New("invalid signature format found while parsing message")
+		return upspin.Signature{}, errors.New("invalid signature format found while parsing message")
 	}
-	sint, success = sint.SetString(ss, sigBase)
+	sint, success := new(big.Int).SetString(ss, sigBase)
 	if !success {
-		return nil, errors.New("invalid signature format found while parsing message")
+		return upspin.Signature{}, errors.New("invalid signature format found while parsing message")
 	}
+	return upspin.Signature{R: rint, S: sint}, nil
+}
 
-	m.sig = upspin.Signature{R: rint, S: sint}
-	return m, nil
+// FormatVersion returns the message's format version.
+func (m *Message) FormatVersion() int {
+	if m.Version == 0 {
+		return 1
+	}
+	return m.Version
 }
 
-func (m *Message) Content() string { return m.content }
+// Migrate returns a copy of m in the current format version signed by c,
+// which must hold the author's key.  The copy records m's signature so that
+// Unmigrated can recover the original message.
+func (m *Message) Migrate(c upspin.Config) (*Message, error) {
+	if !m.IsSigned() {
+		return nil, errors.New("cannot migrate an unsigned message")
+	} else if m.FormatVersion() >= msgVersion {
+		return nil, fmt.Errorf("message %v is already at version %v", m.Name(), m.FormatVersion())
+	}
+
+	cp := *m
+	cp.Version = msgVersion
+	cp.Original = &OriginalSig{Version: m.FormatVersion(), R: fmt.Sprintf("%x", m.sig.R), S: fmt.Sprintf("%x", m.sig.S)}
+	if m.Original != nil {
+		cp.Original = m.Original // keep the first signature
+	}
+	cp.sig = upspin.Signature{}
+	cp.Body = bytes.NewBufferString(m.content)
+	if _, err := cp.Sign(c); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// Unmigrated returns the message as it was before being migrated, carrying
+// its original signature, or m itself if it wasn't migrated.
+func (m *Message) Unmigrated() (*Message, error) {
+	if m.Original == nil {
+		return m, nil
+	}
+	sig, err := parseSig(m.Original.R, m.Original.S)
+	if err != nil {
+		return nil, err
+	}
+	cp := *m
+	cp.Version, cp.Original, cp.sig = m.Original.Version, nil, sig
+	if cp.Version == 1 {
+		cp.Version = 0
+	}
+	return &cp, nil
+}
+
+// Content returns the message's content.  Retracted, pruned, hidden and
+// rejected messages and encrypted messages that haven't been decrypted return
+// a placeholder.
+func (m *Message) Content() string {
+	if m.retracted {
+		return retractedPlaceholder
+	} else if m.rejected {
+		return rejectedPlaceholder
+	} else if m.hidden {
+		return hiddenPlaceholder
+	} else if m.pruned {
+		return prunedPlaceholder
+	} else if m.Encryption == nil {
+		return m.content
+	} else if m.decrypted {
+		return m.plain
+	}
+	return encryptedPlaceholder
+}
 
 func (m *Message) IsSigned() bool { return m.sig.R != nil }
 
+// IsRetracted reports whether the message was retracted by its author.
+func (m *Message) IsRetracted() bool { return m.retracted }
+
+// IsHidden reports whether the message was hidden by a moderator or
+// rejected because its author's role doesn't permit posting.
+func (m *Message) IsHidden() bool { return m.hidden || m.rejected }
+
+// IsPruned reports whether the message is a placeholder for a message pruned
+// by a retention policy.
+func (m *Message) IsPruned() bool { return m.pruned }
+
+// File returns the path the message was read from or "" if it wasn't read
+// from a file.
+func (m *Message) File() upspin.PathName { return m.file }
+
 func (m *Message) Name() MsgName { return m.Parent.NextName(m.Author) }
 
+// From describes who wrote the message.  For relayed messages this is the
+// original author along with the relaying user.
+func (m *Message) From() string {
+	if m.Origin == nil {
+		return string(m.Author)
+	}
+	return fmt.Sprintf("%v (%v via %v)", m.Origin.From, m.Origin.Source, m.Author)
+}
+
 func (m *Message) String() string {
-	content := strings.Replace(m.content, "\n", "\n    ", -1)
+	content := strings.Replace(m.Content(), "\n", "\n    ", -1)
 	return fmt.Sprintf("%v on %v\n    %v\n",
-		m.Author, m.Time.Format(time.UnixDate), content)
+		m.From(), m.Time.Format(time.UnixDate), content)
 }
 
+// contentHash returns the hash that is signed.  Messages before version 4
+// sign the hash of their file's header and content.
 func (m *Message) contentHash() []byte {
+	if m.Version >= 4 {
+		h := sha256.Sum256(m.canonical())
+		return h[:]
+	}
 	h := sha256.Sum256([]byte(m.payloadNoSig()))
 	return h[:]
 }
 
 func (m *Message) payloadNoSig() string {
 	var header = struct {
+		Version       int `json:",omitempty"`
 		Author        string
 		Time          time.Time
 		ParentMessage string
 		Title         string
-	}{string(m.Author), m.Time, string(m.Parent), m.Title}
+		Origin        *Origin      `json:",omitempty"`
+		Encryption    *Encryption  `json:",omitempty"`
+		Retracts      string       `json:",omitempty"`
+		Hides         string       `json:",omitempty"`
+		Original      *OriginalSig `json:",omitempty"`
+		Length        int          `json:",omitempty"`
+	}{m.Version, string(m.Author), m.Time, string(m.Parent), m.Title, m.Origin, m.Encryption, string(m.Retracts), string(m.Hides), m.Original, 0}
+	if m.Version >= 3 {
+		header.Length = len(m.content)
+	}
 	data, err := json.MarshalIndent(header, "", "    ")
 	if err != nil {
 		panic(err)
@@ -192,6 +458,12 @@ func (m *Message) Payload() (string, error) {
 }
 
 func (m *Message) Send(c upspin.Config, root upspin.PathName) (err error) {
+	return m.send(client.New(c), c, root)
+}
+
+// send signs m with c if necessary and writes it to its conversation directory
+// under root using cl.
+func (m *Message) send(cl upspin.Client, c upspin.Config, root upspin.PathName) (err error) {
 	if !m.IsSigned() {
 		if _, err := m.Sign(c); err != nil {
 			return err
@@ -201,8 +473,6 @@ func (m *Message) Send(c upspin.Config, root upspin.PathName) (err error) {
 	dir := Join(root, m.Title)
 	pth := Join(dir, string(m.Name()))
 
-	cl := client.New(c)
-
 	if err := MakeDirs(cl, dir); err != nil {
 		return fmt.Errorf("failed to create conversation directory %v", dir)
 	}
@@ -252,5 +522,9 @@ func (m *Message) Verify(c upspin.Config) error {
 	if err != nil {
 		return fmt.Errorf("failed to discover message author's public key: %v", err)
 	}
+	return m.verifyKey(key)
+}
+
+func (m *Message) verifyKey(key upspin.PublicKey) error {
 	return factotum.Verify(m.contentHash(), m.sig, key)
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"strings"
 	"testing"
 
 	"upspin.io/config"
@@ -50,3 +51,84 @@ func TestMessage(t *testing.T) {
 		t.Logf("payload:\n%v\n", payload)
 	}
 }
+
+func FuzzParseMessage(f *testing.F) {
+	cfg := newTestConfig(f, "alice@example.com")
+	bodies := []string{"hello", "", msgHeaderMarker, msgSigHeader + "\n1\n2\n", "trailing" + msgSigHeader}
+	for _, version := range []int{0, msgVersion} {
+		for _, body := range bodies {
+			m := NewMessage(cfg.UserName(), "title", NewMsgName("bob@example.com", 3), bytes.NewBufferString(body))
+			m.Version = version
+			payload, err := m.Sign(cfg)
+			if err != nil {
+				f.Fatal(err)
+			}
+			f.Add([]byte(payload))
+		}
+	}
+	f.Add([]byte("null\n" + msgHeaderMarker + msgSigHeader + "\n1\n2\n"))
+	f.Add([]byte(`{"Version": 3, "Length": 99999999999}` + "\n" + msgHeaderMarker))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := ParseMessage(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		m.Name()
+
+		// a parsed message's payload parses to the same message
+		payload, err := m.Payload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m2, err := ParseMessage(strings.NewReader(payload))
+		if err != nil {
+			t.Fatalf("failed to reparse payload: %v\n%q", err, payload)
+		}
+		if payload2, _ := m2.Payload(); payload2 != payload {
+			t.Errorf("payloads differ:\n%q\n%q", payload, payload2)
+		}
+	})
+}
+
+func FuzzMessageBody(f *testing.F) {
+	cfg := newTestConfig(f, "alice@example.com")
+	f.Add("title", "hello")
+	f.Add("title", msgSigHeader+"\n1\n2\n")
+	f.Add("a\nb", msgHeaderMarker+msgHeaderMarker)
+
+	f.Fuzz(func(t *testing.T, title, body string) {
+		m := NewMessage(cfg.UserName(), title, "", strings.NewReader(body))
+		payload, err := m.Sign(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := ParseMessage(strings.NewReader(payload))
+		if err != nil {
+			t.Fatalf("failed to parse: %v\n%q", err, payload)
+		} else if parsed.Content() != body {
+			t.Errorf("content %q, want %q", parsed.Content(), body)
+		} else if err := parsed.verifyKey(cfg.f.PublicKey()); err != nil {
+			t.Errorf("failed to verify: %v", err)
+		}
+	})
+}
+
+func FuzzMsgName(f *testing.F) {
+	for _, name := range []string{"msg1-alice@example.com.txt", "msg-.txt", "msg01-a.txt", "msg1.txt", "msg", "msg1-a-b.txt", "msg+1-a.txt"} {
+		f.Add(name)
+	}
+
+	f.Fuzz(func(t *testing.T, name string) {
+		n, err := ParseMsgName(name)
+		if err != nil {
+			if num, user := MsgName(name).Number(), MsgName(name).User(); num != 0 || user != "" {
+				t.Errorf("malformed name %q has number %v and user %q", name, num, user)
+			}
+			return
+		}
+		if got := NewMsgName(n.User(), n.Number()); got != n {
+			t.Errorf("name %q rebuilt as %q", n, got)
+		}
+	})
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"upspin.io/factotum"
+	"upspin.io/upspin"
+)
+
+const (
+	metaPrefix    = "meta-"
+	metaExtension = "json"
+)
+
+// Conversation modes recorded in metadata.
+const (
+	// ModePullOnly conversations are never pushed to other participants'
+	// copies; they fetch new messages with sync.
+	ModePullOnly = "pull-only"
+	// ModeAnnounceOnly conversations only accept posts from their owners.
+	// Other participants subscribe: they may read the owners' copies but
+	// not write to them, and pull new posts rather than having them pushed.
+	ModeAnnounceOnly = "announce-only"
+)
+
+var knownModes = []string{ModePullOnly, ModeAnnounceOnly}
+
+// Participant roles recorded in metadata, from most to least privileged.
+const (
+	// RoleOwner participants may change roles and modes and hide messages.
+	RoleOwner = "owner"
+	// RoleModerator participants may hide messages.
+	RoleModerator = "moderator"
+	// RoleMember participants may post.  It is the default role except in
+	// announcements.
+	RoleMember = "member"
+	// RoleReader participants may only read.  It is the default role in
+	// announcements.
+	RoleReader = "reader"
+)
+
+var knownRoles = []string{RoleOwner, RoleModerator, RoleMember, RoleReader}
+
+// roleRights holds the rights granted to each role in Access files.
+// Participants only ever add files to each other's copies, so no role may
+// overwrite or delete them.
+var roleRights = map[string]string{
+	RoleOwner:     "read,create,list",
+	RoleModerator: "read,create,list",
+	RoleMember:    "read,create,list",
+	RoleReader:    "read,list",
+}
+
+// Metadata describes a conversation.  Each participant may write their own
+// signed metadata file in the conversation.  Each version names the version
+// it changes, and the current one is found by following these links from the
+// creator's, except that only owners may change the creator, modes, owners
+// and roles (see ReadMetadata).
+type Metadata struct {
+	// Conversation is the title of the conversation described, so that
+	// metadata can't be copied into another conversation.
+	Conversation string
+	// Name is the conversation's display name if it has been renamed.  The
+	// conversation's title remains its stable ID.
+	Name        string   `json:",omitempty"`
+	Description string   `json:",omitempty"`
+	Tags        []string `json:",omitempty"`
+	Created     time.Time
+	Creator     upspin.UserName
+	Modes       []string `json:",omitempty"`
+	// Owners lists the users besides Creator who own the conversation.
+	Owners []upspin.UserName `json:",omitempty"`
+	// Roles holds participants' roles other than the default.
+	Roles map[upspin.UserName]string `json:",omitempty"`
+	// Based is the hex encoded SHA-256 hash of the bytes signed for the
+	// version this one changes, or empty for a first version.
+	Based string `json:",omitempty"`
+	// Author wrote this version of the metadata at Time.
+	Author upspin.UserName
+	Time   time.Time
+	// R and S hold the hex encoded signature by Author.
+	R, S string
+
+	// hash is set to the version's hash once it is read or signed.
+	hash string
+}
+
+// metaName returns the name of u's metadata file.
+func metaName(u upspin.UserName) string {
+	return fmt.Sprintf("%v%v.%v", metaPrefix, u, metaExtension)
+}
+
+// isMetaFile reports whether the file at p is named like a metadata file.
+func isMetaFile(p upspin.PathName) bool {
+	return metaUser(path.Base(string(p))) != ""
+}
+
+// metaUser returns the user whose metadata file has the given name or "" if
+// it isn't a metadata file name.
+func metaUser(name string) upspin.UserName {
+	if !strings.HasPrefix(name, metaPrefix) || !strings.HasSuffix(name, "."+metaExtension) {
+		return ""
+	}
+	return upspin.UserName(strings.TrimSuffix(strings.TrimPrefix(name, metaPrefix), "."+metaExtension))
+}
+
+// canonical returns the bytes signed for the metadata, using the encoding
+// described for messages with its own magic line and fields.  The name,
+// owner, role and based fields are written only if set so metadata signed
+// before they existed still verifies.
+func (md *Metadata) canonical() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("converse metadata\n")
+	writeField(&buf, "conversation", md.Conversation)
+	if md.Name != "" {
+		writeField(&buf, "name", md.Name)
+	}
+	writeField(&buf, "description", md.Description)
+	writeField(&buf, "tags", fmt.Sprint(len(md.Tags)))
+	for _, tag := range md.Tags {
+		writeField(&buf, "tag", tag)
+	}
+	md.writeGovernance(&buf)
+	if md.Based != "" {
+		writeField(&buf, "based", md.Based)
+	}
+	writeField(&buf, "author", string(md.Author))
+	writeField(&buf, "time", md.Time.UTC().Format(time.RFC3339Nano))
+	return buf.Bytes()
+}
+
+// writeGovernance writes the canonical fields that only owners may change.
+func (md *Metadata) writeGovernance(buf *bytes.Buffer) {
+	writeField(buf, "created", md.Created.UTC().Format(time.RFC3339Nano))
+	writeField(buf, "creator", string(md.Creator))
+	writeField(buf, "modes", fmt.Sprint(len(md.Modes)))
+	for _, mode := range md.Modes {
+		writeField(buf, "mode", mode)
+	}
+	if len(md.Owners) > 0 {
+		writeField(buf, "owners", fmt.Sprint(len(md.Owners)))
+		for _, u := range md.Owners {
+			writeField(buf, "owner", string(u))
+		}
+	}
+	if len(md.Roles) > 0 {
+		var users []string
+		for u := range md.Roles {
+			users = append(users, string(u))
+		}
+		sort.Strings(users)
+		writeField(buf, "roles", fmt.Sprint(len(users)))
+		for _, u := range users {
+			writeField(buf, "role.user", u)
+			writeField(buf, "role.name", md.Roles[upspin.UserName(u)])
+		}
+	}
+}
+
+// sameGovernance reports whether md and o agree on the fields only owners
+// may change.
+func (md *Metadata) sameGovernance(o *Metadata) bool {
+	var a, b bytes.Buffer
+	md.writeGovernance(&a)
+	o.writeGovernance(&b)
+	return bytes.Equal(a.Bytes(), b.Bytes())
+}
+
+// Sign sets the metadata's author and time, bases it on the version it was
+// read or last signed as, and signs it with c's key.
+func (md *Metadata) Sign(c upspin.Config) error {
+	md.Based, md.Author, md.Time = md.hash, c.UserName(), time.Now()
+	h := sha256.Sum256(md.canonical())
+	sig, err := c.Factotum().Sign(h[:])
+	if err != nil {
+		return err
+	}
+	md.R, md.S = fmt.Sprintf("%x", sig.R), fmt.Sprintf("%x", sig.S)
+	md.hash = fmt.Sprintf("%x", h)
+	return nil
+}
+
+// Verify checks the metadata's signature against key.
+func (md *Metadata) Verify(key upspin.PublicKey) error {
+	sig, err := parseSig(md.R, md.S)
+	if err != nil {
+		return err
+	}
+	h := sha256.Sum256(md.canonical())
+	return factotum.Verify(h[:], sig, key)
+}
+
+// HasMode reports whether the given mode is set.
+func (md *Metadata) HasMode(mode string) bool { return contains(md.Modes, mode) }
+
+// IsOwner reports whether u owns the conversation.
+func (md *Metadata) IsOwner(u upspin.UserName) bool { return md.RoleOf(u) == RoleOwner }
+
+// RoleOf returns u's role in the conversation.  The creator and Owners are
+// owners; other participants without a role are readers in announcements
+// and members otherwise.
+func (md *Metadata) RoleOf(u upspin.UserName) string {
+	if u == md.Creator {
+		return RoleOwner
+	}
+	for _, o := range md.Owners {
+		if o == u {
+			return RoleOwner
+		}
+	}
+	if role, ok := md.Roles[u]; ok {
+		return role
+	} else if md.HasMode(ModeAnnounceOnly) {
+		return RoleReader
+	}
+	return RoleMember
+}
+
+// SetRole gives u the role, which must be a known role.  The creator is
+// always an owner.
+func (md *Metadata) SetRole(u upspin.UserName, role string) error {
+	if !contains(knownRoles, role) {
+		return fmt.Errorf("unknown role '%v'", role)
+	} else if u == md.Creator && role != RoleOwner {
+		return fmt.Errorf("%v created the conversation and is always an owner", u)
+	}
+
+	var owners []upspin.UserName
+	for _, o := range md.Owners {
+		if o != u {
+			owners = append(owners, o)
+		}
+	}
+	md.Owners = owners
+	if md.Roles == nil {
+		md.Roles = map[upspin.UserName]string{}
+	}
+	md.Roles[u] = role
+	return nil
+}
+
+// HasTag reports whether the conversation is tagged with tag.
+func (md *Metadata) HasTag(tag string) bool { return contains(md.Tags, tag) }
+
+// SetModes replaces the metadata's modes, which must be known modes.
+func (md *Metadata) SetModes(modes []string) error {
+	for _, mode := range modes {
+		if !contains(knownModes, mode) {
+			return fmt.Errorf("unknown conversation mode '%v'", mode)
+		}
+	}
+	md.Modes = modes
+	return nil
+}
+
+func (md *Metadata) String() string {
+	var buf bytes.Buffer
+	if md.Name != "" {
+		fmt.Fprintf(&buf, "name: %v\n", md.Name)
+	}
+	fmt.Fprintf(&buf, "description: %v\n", md.Description)
+	fmt.Fprintf(&buf, "tags: %v\n", strings.Join(md.Tags, ", "))
+	fmt.Fprintf(&buf, "modes: %v\n", strings.Join(md.Modes, ", "))
+	if len(md.Owners) > 0 {
+		fmt.Fprintf(&buf, "owners: %v\n", md.Owners)
+	}
+	var users []string
+	for u := range md.Roles {
+		users = append(users, string(u))
+	}
+	sort.Strings(users)
+	for _, u := range users {
+		fmt.Fprintf(&buf, "role: %v %v\n", u, md.Roles[upspin.UserName(u)])
+	}
+	fmt.Fprintf(&buf, "created: %v by %v\n", md.Created.Format(time.UnixDate), md.Creator)
+	fmt.Fprintf(&buf, "updated: %v by %v\n", md.Time.Format(time.UnixDate), md.Author)
+	return buf.String()
+}
+
+// ReadMetadata returns the current metadata of the conversation at convpath.
+// Metadata files whose signature doesn't verify with their author's key as
+// returned by keyFor, that describe another conversation or that name anyone
+// but the creator found by creatorOf as its creator are ignored.  The chain
+// of versions starts from the creator's file or, if the creator hasn't
+// written one, the first stored file that sets no modes, owners or roles and
+// isn't based on another version.  It is extended by a file based on the
+// current version whose author is an owner according to the current version
+// or that doesn't change the fields only owners may change, taking the first
+// stored if several are.  Versions therefore can't be reordered by the times
+// their authors give them, and a change based on a superseded version is
+// ignored.  It returns nil if there is no metadata.
+func ReadMetadata(cl upspin.Client, convpath upspin.PathName, keyFor func(upspin.UserName) (upspin.PublicKey, error)) (*Metadata, error) {
+	ents, err := cl.Glob(string(Join(convpath, metaPrefix+"*."+metaExtension)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list conversation metadata: %v", err)
+	}
+	creator, err := creatorOf(cl, convpath, keyFor)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(ents, func(i, j int) bool { return ents[i].Sequence < ents[j].Sequence })
+	var mds []*Metadata
+	for _, ent := range ents {
+		data, err := cl.Get(ent.SignedName)
+		if err != nil {
+			continue
+		}
+		md := &Metadata{}
+		if err := json.Unmarshal(data, md); err != nil || md.Author != metaUser(path.Base(string(ent.SignedName))) || md.Conversation != path.Base(string(convpath)) || md.Creator != creator {
+			continue
+		}
+		if key, err := keyFor(md.Author); err != nil || md.Verify(key) != nil {
+			continue
+		}
+		md.hash = fmt.Sprintf("%x", sha256.Sum256(md.canonical()))
+		mds = append(mds, md)
+	}
+
+	var cur *Metadata
+	for _, md := range mds {
+		if md.Author == creator {
+			cur = md
+		}
+	}
+	for _, md := range mds {
+		// anyone may start with the governance implied by having no
+		// metadata
+		if cur == nil && md.Based == "" && len(md.Modes) == 0 && len(md.Owners) == 0 && len(md.Roles) == 0 {
+			cur = md
+		}
+	}
+	for cur != nil {
+		var next *Metadata
+		for _, md := range mds {
+			if md.Based == cur.hash && (cur.IsOwner(md.Author) || md.sameGovernance(cur)) {
+				next = md
+				break
+			}
+		}
+		if next == nil {
+			break
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+// creatorOf returns the creator of the conversation at convpath: the owner of
+// its directory if our copy holds a first message by them, or else the
+// author of the first message stored earliest.  Only first messages that
+// verify with their author's key as returned by keyFor count, along with
+// pruned ones recorded in tombstones signed by the directory owner, which
+// are taken to precede the rest since pruning removes the oldest messages.
+// Storage order comes from the sequence numbers the server assigns, which
+// participants can't change since they may only create files in each other's
+// copies.  A conversation without first messages was created by the
+// directory owner.
+func creatorOf(cl upspin.Client, convpath upspin.PathName, keyFor func(upspin.UserName) (upspin.PublicKey, error)) (upspin.UserName, error) {
+	owner := upspin.UserName(strings.SplitN(string(convpath), "/", 2)[0])
+	pattern := msgPrefix + "1-*." + msgExtension
+	var firsts []upspin.UserName
+	for _, dir := range []upspin.PathName{Join(convpath, tombstoneDir), convpath} {
+		ents, err := cl.Glob(string(Join(dir, pattern)))
+		if err != nil {
+			return "", fmt.Errorf("failed to list conversation messages: %v", err)
+		}
+		sort.Slice(ents, func(i, j int) bool { return ents[i].Sequence < ents[j].Sequence })
+
+		for _, ent := range ents {
+			name := MsgName(path.Base(string(ent.SignedName)))
+			if name.Number() != 1 {
+				continue
+			}
+			if dir != convpath {
+				if ts := prunedTombstone(cl, convpath, ent.SignedName, owner, keyFor); ts != nil && ts.Message.Author == name.User() {
+					firsts = append(firsts, name.User())
+				}
+				continue
+			}
+			key, err := keyFor(name.User())
+			if err != nil {
+				continue
+			}
+			if m, err := ReadMessage(cl, ent.SignedName); err == nil && m.Name() == name && m.verifyKey(key) == nil {
+				firsts = append(firsts, name.User())
+			}
+		}
+	}
+
+	for _, u := range firsts {
+		if u == owner {
+			return owner, nil
+		}
+	}
+	if len(firsts) > 0 {
+		return firsts[0], nil
+	}
+	return owner, nil
+}
+
+// LoadMetadata reads the conversation's current metadata as ReadMetadata
+// does, records it as the conversation's Metadata and sets the
+// conversation's display name from it.
+func (c *Conversation) LoadMetadata(cl upspin.Client, keyFor func(upspin.UserName) (upspin.PublicKey, error)) (*Metadata, error) {
+	md, err := ReadMetadata(cl, c.Location, keyFor)
+	if err != nil {
+		return nil, err
+	}
+	c.Metadata = md
+	if md != nil {
+		c.Name = md.Name
+	}
+	c.applyRoles()
+	return md, nil
+}
+
+// IsAnnouncement reports whether the conversation's metadata puts it in
+// announce-only mode.
+func (c *Conversation) IsAnnouncement() bool {
+	return c.Metadata != nil && c.Metadata.HasMode(ModeAnnounceOnly)
+}
+
+// RoleOf returns u's role according to the conversation's metadata.  Without
+// metadata everyone is a member.
+func (c *Conversation) RoleOf(u upspin.UserName) string {
+	if c.Metadata == nil {
+		return RoleMember
+	}
+	return c.Metadata.RoleOf(u)
+}
+
+// CanPost reports whether u may post to the conversation: members,
+// moderators and owners may, except in announcements which only owners may
+// post to.
+func (c *Conversation) CanPost(u upspin.UserName) bool {
+	role := c.RoleOf(u)
+	if c.IsAnnouncement() {
+		return role == RoleOwner
+	}
+	return role != RoleReader
+}
+
+// CanModerate reports whether u may hide messages in the conversation.
+func (c *Conversation) CanModerate(u upspin.UserName) bool {
+	role := c.RoleOf(u)
+	return role == RoleOwner || role == RoleModerator
+}
+
+// NewMetadata returns metadata for conv recording its first message's author
+// and time (or u and the current time if it has none) as its creation.
+func NewMetadata(conv *Conversation, u upspin.UserName) *Metadata {
+	md := &Metadata{Creator: u, Created: time.Now()}
+	if len(conv.Messages) > 0 {
+		md.Creator, md.Created = conv.Messages[0].Author, conv.Messages[0].Time
+	}
+	return md
+}
+
+// WriteMetadata signs md as describing the conversation with the given title
+// with c's key and writes it as c's user's metadata file in the conversation
+// directory beneath each of the given roots.  Participants may only create
+// files in each other's copies, so replacing the file beneath another user's
+// root fails once it exists; their copies pick up the change when synced.
+// It returns the first error encountered writing beneath c's user's root.
+func WriteMetadata(cl upspin.Client, c upspin.Config, title string, md *Metadata, roots ...upspin.PathName) error {
+	md.Conversation = title
+	if err := md.Sign(c); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(md, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	var first error
+	for _, root := range roots {
+		_, err := cl.Put(Join(root, title, metaName(c.UserName())), data)
+		if err != nil && first == nil && strings.HasPrefix(string(root), string(c.UserName())+"/") {
+			first = err
+		}
+	}
+	if first != nil {
+		return errors.New("failed to write metadata: " + first.Error())
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"strings"
+	"testing"
+	"time"
+
+	"upspin.io/upspin"
+)
+
+func TestMetadata(t *testing.T) {
+	store := newMemClient()
+	alice := newTestConfig(t, "alice@example.com")
+	bob := newTestConfig(t, "bob@example.com")
+	convpath := ConvPath(alice.UserName(), "plans")
+	pubkeys := map[upspin.UserName]upspin.PublicKey{alice.UserName(): alice.f.PublicKey(), bob.UserName(): bob.f.PublicKey()}
+	keyFor := func(u upspin.UserName) (upspin.PublicKey, error) {
+		if key, ok := pubkeys[u]; ok {
+			return key, nil
+		}
+		return "", fmt.Errorf("no key for %v", u)
+	}
+
+	if md, err := ReadMetadata(store, convpath, keyFor); err != nil || md != nil {
+		t.Fatalf("got %v, %v for conversation without metadata", md, err)
+	}
+
+	md := &Metadata{Description: "weekend plans", Tags: []string{"family"}, Creator: alice.UserName(), Created: time.Now()}
+	if err := md.SetModes([]string{"pull-only", "loud"}); err == nil {
+		t.Errorf("unknown mode accepted")
+	}
+	if err := md.SetModes([]string{ModePullOnly}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteMetadata(store, alice, "plans", md, DefaultRoot(alice.UserName())); err != nil {
+		t.Fatal(err)
+	}
+	if err := md.Verify(bob.f.PublicKey()); err == nil {
+		t.Errorf("metadata verified with wrong key")
+	}
+
+	got, err := ReadMetadata(store, convpath, keyFor)
+	if err != nil {
+		t.Fatal(err)
+	} else if got == nil || got.Description != "weekend plans" || !got.HasTag("family") || !got.HasMode(ModePullOnly) {
+		t.Fatalf("read metadata %+v", got)
+	}
+
+	// A later update by bob supersedes alice's.
+	got.Description = "camping"
+	if err := WriteMetadata(store, bob, "plans", got, DefaultRoot(alice.UserName())); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ReadMetadata(store, convpath, keyFor); got == nil || got.Description != "camping" || got.Author != bob.UserName() {
+		t.Fatalf("read metadata %+v, want bob's update", got)
+	}
+
+	// Tampered or forged metadata is ignored.
+	tampered := *got
+	tampered.Description = "tampered"
+	tampered.Time = time.Now().Add(time.Hour)
+	data, _ := json.Marshal(&tampered)
+	if _, err := store.Put(Join(convpath, metaName(bob.UserName())), data); err != nil {
+		t.Fatal(err)
+	}
+	forged := tampered
+	forged.Author = "carol@example.com"
+	data, _ = json.Marshal(&forged)
+	if _, err := store.Put(Join(convpath, metaName(alice.UserName())), data); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ReadMetadata(store, convpath, keyFor); got != nil {
+		t.Errorf("read unverified metadata %+v", got)
+	}
+
+	// So is metadata signed for another conversation.
+	if err := WriteMetadata(store, alice, "other", md, DefaultRoot(alice.UserName())); err != nil {
+		t.Fatal(err)
+	}
+	data, err = store.Get(Join(ConvPath(alice.UserName(), "other"), metaName(alice.UserName())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Put(Join(convpath, metaName(alice.UserName())), data); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ReadMetadata(store, convpath, keyFor); got != nil {
+		t.Errorf("read another conversation's metadata %+v", got)
+	}
+}
+
+// TestMetadataCreator checks that a participant can't take over a
+// conversation by adding a first message and metadata naming themselves its
+// creator, however they date them.
+func TestMetadataCreator(t *testing.T) {
+	store := newMemClient()
+	alice := newTestConfig(t, "alice@example.com")
+	mallory := newTestConfig(t, "mallory@example.com")
+	root := DefaultRoot("bob@example.com")
+	pubkeys := TrustedKeys{alice.UserName(): alice.f.PublicKey(), mallory.UserName(): mallory.f.PublicKey()}
+
+	conv := NewConversation(root, "plans")
+	first := conv.Add(alice.UserName(), bytes.NewBufferString("hi"))
+	if err := first.send(store, alice, root); err != nil {
+		t.Fatal(err)
+	}
+	claim := &Metadata{Creator: mallory.UserName(), Created: first.Time.Add(-time.Hour), Modes: []string{ModeAnnounceOnly}}
+	if err := WriteMetadata(store, mallory, "plans", claim, root); err != nil {
+		t.Fatal(err)
+	}
+	early := NewMessage(mallory.UserName(), "plans", "", bytes.NewBufferString("I was here first"))
+	early.Time = first.Time.Add(-time.Hour)
+	if err := early.send(store, mallory, root); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ReadMetadata(store, conv.Location, pubkeys.Key); err != nil || got != nil {
+		t.Errorf("mallory's claim read as %+v, %v", got, err)
+	}
+
+	md := &Metadata{Description: "weekend", Creator: alice.UserName(), Created: first.Time}
+	if err := WriteMetadata(store, alice, "plans", md, root); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadMetadata(store, conv.Location, pubkeys.Key)
+	if err != nil {
+		t.Fatal(err)
+	} else if got == nil || got.Author != alice.UserName() || got.RoleOf(mallory.UserName()) != RoleMember {
+		t.Errorf("read metadata %+v, want alice's", got)
+	}
+}
+
+// TestMetadataChain checks that an owner can't override another owner's
+// change by dating their own before or after it.
+func TestMetadataChain(t *testing.T) {
+	store := newMemClient()
+	alice := newTestConfig(t, "alice@example.com")
+	bob := newTestConfig(t, "bob@example.com")
+	carol := newTestConfig(t, "carol@example.com")
+	root := DefaultRoot(alice.UserName())
+	convpath := ConvPath(alice.UserName(), "plans")
+	pubkeys := TrustedKeys{}
+	for _, c := range []*testConfig{alice, bob, carol} {
+		pubkeys[c.UserName()] = c.f.PublicKey()
+	}
+
+	md := &Metadata{Creator: alice.UserName(), Created: time.Now(), Owners: []upspin.UserName{bob.UserName(), carol.UserName()}}
+	if err := WriteMetadata(store, alice, "plans", md, root); err != nil {
+		t.Fatal(err)
+	}
+	base, err := ReadMetadata(store, convpath, pubkeys.Key)
+	if err != nil || base == nil {
+		t.Fatalf("read metadata %+v, %v", base, err)
+	}
+	// carol removes bob as an owner
+	removed := *base
+	removed.Owners = []upspin.UserName{carol.UserName()}
+	if err := WriteMetadata(store, carol, "plans", &removed, root); err != nil {
+		t.Fatal(err)
+	}
+
+	// bob, working from the version before carol's, removes her and dates
+	// his change before and then after hers
+	for _, at := range []time.Time{base.Time.Add(time.Nanosecond), time.Now().Add(time.Hour)} {
+		override := *base
+		override.Owners = []upspin.UserName{bob.UserName()}
+		if err := override.Sign(bob); err != nil {
+			t.Fatal(err)
+		}
+		override.Time = at
+		h := sha256.Sum256(override.canonical())
+		sig, err := bob.Factotum().Sign(h[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		override.R, override.S = fmt.Sprintf("%x", sig.R), fmt.Sprintf("%x", sig.S)
+		data, _ := json.Marshal(&override)
+		if _, err := store.Put(Join(convpath, metaName(bob.UserName())), data); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := ReadMetadata(store, convpath, pubkeys.Key)
+		if err != nil {
+			t.Fatal(err)
+		} else if got == nil || got.Author != carol.UserName() || got.IsOwner(bob.UserName()) {
+			t.Errorf("bob's change dated %v overrode carol's: %+v", at, got)
+		}
+	}
+}
+
+func TestRename(t *testing.T) {
+	store := newMemClient()
+	alice := newTestConfig(t, "alice@example.com")
+	keyFor := func(u upspin.UserName) (upspin.PublicKey, error) { return alice.f.PublicKey(), nil }
+
+	conv := NewConversation(DefaultRoot(alice.UserName()), "plans")
+	m := conv.Add(alice.UserName(), bytes.NewBufferString("hi"))
+	if err := m.send(store, alice, DefaultRoot(alice.UserName())); err != nil {
+		t.Fatal(err)
+	}
+
+	// Metadata signed without a name keeps verifying.
+	md := NewMetadata(conv, alice.UserName())
+	if err := md.Sign(alice); err != nil {
+		t.Fatal(err)
+	}
+	unnamed := md.canonical()
+	md.Name = "weekend plans"
+	if err := WriteMetadata(store, alice, "plans", md, DefaultRoot(alice.UserName())); err != nil {
+		t.Fatal(err)
+	} else if bytes.Equal(md.canonical(), unnamed) {
+		t.Errorf("name isn't signed")
+	}
+
+	conv, err := ReadConversation(store, conv.Location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conv.LoadMetadata(store, keyFor); err != nil {
+		t.Fatal(err)
+	}
+	if got := conv.DisplayName(); got != "weekend plans" {
+		t.Errorf("display name %q, want %q", got, "weekend plans")
+	} else if conv.Title() != "plans" {
+		t.Errorf("title changed to %q", conv.Title())
+	}
+	if err := conv.Messages[0].verifyKey(alice.f.PublicKey()); err != nil {
+		t.Errorf("renamed conversation's message doesn't verify: %v", err)
+	}
+
+	tmpl := template.Must(template.New("").Parse("{{.Title}}"))
+	if html, err := conv.Html(tmpl); err != nil || string(html) != "weekend plans" {
+		t.Errorf("rendered %q, %v", html, err)
+	}
+}
+
+func TestAnnouncement(t *testing.T) {
+	store := newMemClient()
+	alice := newTestConfig(t, "alice@example.com")
+	bob := newTestConfig(t, "bob@example.com")
+	keyFor := func(u upspin.UserName) (upspin.PublicKey, error) { return alice.f.PublicKey(), nil }
+
+	conv := NewConversation(DefaultRoot(alice.UserName()), "news")
+	m := conv.Add(alice.UserName(), bytes.NewBufferString("*launched*"))
+	if err := m.send(store, alice, DefaultRoot(alice.UserName())); err != nil {
+		t.Fatal(err)
+	}
+	if !conv.CanPost(bob.UserName()) {
+		t.Errorf("bob can't post to an ordinary conversation")
+	}
+
+	md := NewMetadata(conv, alice.UserName())
+	if err := md.SetModes([]string{ModeAnnounceOnly}); err != nil {
+		t.Fatal(err)
+	}
+	md.Owners = []upspin.UserName{"carol@example.com"}
+	if err := WriteMetadata(store, alice, "news", md, DefaultRoot(alice.UserName())); err != nil {
+		t.Fatal(err)
+	}
+
+	conv, err := ReadConversation(store, conv.Location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conv.LoadMetadata(store, keyFor); err != nil {
+		t.Fatal(err)
+	}
+	if !conv.IsAnnouncement() {
+		t.Fatalf("conversation isn't an announcement")
+	}
+	for u, want := range map[upspin.UserName]bool{alice.UserName(): true, "carol@example.com": true, bob.UserName(): false} {
+		if got := conv.CanPost(u); got != want {
+			t.Errorf("%v can post: %v, want %v", u, got, want)
+		}
+	}
+
+	// Switching to announce-only downgrades existing grants.
+	access := "*: alice@example.com\nread,create,list: bob@example.com, carol@example.com\nread,create,list: friends@example.com/Group"
+	if _, err := store.Put(Join(conv.Location, "Access"), []byte(access)); err != nil {
+		t.Fatal(err)
+	}
+	if err := conv.refreshRights(store, alice.UserName()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := store.Get(Join(conv.Location, "Access"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "*: alice@example.com\nread,list: bob@example.com\n" + roleRights[RoleOwner] + ": carol@example.com\nread,list: friends@example.com/Group"
+	if string(data) != want {
+		t.Errorf("refreshed Access file:\n%s\nwant:\n%s", data, want)
+	}
+
+	if err := conv.Publish(store, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err = store.Get(Join(conv.Location, feedFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`<feed xmlns="http://www.w3.org/2005/Atom">`, "<title>news</title>", "<name>alice@example.com</name>", "*launched*"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("feed missing %q:\n%s", want, data)
+		}
+	}
+}
+
+func TestRoles(t *testing.T) {
+	store := newMemClient()
+	alice := newTestConfig(t, "alice@example.com")
+	bob := newTestConfig(t, "bob@example.com")
+	carol := newTestConfig(t, "carol@example.com")
+	root := DefaultRoot(alice.UserName())
+	pubkeys := TrustedKeys{}
+	for _, c := range []*testConfig{alice, bob, carol} {
+		pubkeys[c.UserName()] = c.f.PublicKey()
+	}
+	useKeys(t, pubkeys)
+
+	conv := NewConversation(root, "plans")
+	var msgs []*Message
+	for _, c := range []*testConfig{alice, bob, carol} {
+		m := conv.Add(c.UserName(), bytes.NewBufferString("hi from "+string(c.UserName())))
+		if err := m.send(store, c, root); err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, m)
+	}
+
+	md := NewMetadata(conv, alice.UserName())
+	if err := md.SetRole(alice.UserName(), RoleReader); err == nil {
+		t.Errorf("creator demoted")
+	}
+	if err := md.SetRole(bob.UserName(), "admin"); err == nil {
+		t.Errorf("unknown role accepted")
+	}
+	if err := md.SetRole(bob.UserName(), RoleModerator); err != nil {
+		t.Fatal(err)
+	}
+	if err := md.SetRole(carol.UserName(), RoleReader); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteMetadata(store, alice, "plans", md, root); err != nil {
+		t.Fatal(err)
+	}
+
+	// Non-owners may only change fields other than the roles and modes.
+	promoted := *md
+	promoted.Roles = map[upspin.UserName]string{bob.UserName(): RoleOwner, carol.UserName(): RoleReader}
+	if err := WriteMetadata(store, bob, "plans", &promoted, root); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadMetadata(store, conv.Location, ConversationKeys)
+	if err != nil {
+		t.Fatal(err)
+	} else if got == nil || got.Author != alice.UserName() || got.RoleOf(bob.UserName()) != RoleModerator {
+		t.Fatalf("bob promoted himself: %+v", got)
+	}
+	described := *md
+	described.Description = "weekend"
+	if err := WriteMetadata(store, bob, "plans", &described, root); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ReadMetadata(store, conv.Location, ConversationKeys); got == nil || got.Description != "weekend" {
+		t.Errorf("bob's description not accepted: %+v", got)
+	}
+
+	conv, err = ReadConversation(store, conv.Location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := conv.Messages[2].Content(); got != rejectedPlaceholder {
+		t.Errorf("reader's message has content %q", got)
+	}
+	// dating a post before the demotion doesn't get it accepted
+	backdated := conv.Add(carol.UserName(), bytes.NewBufferString("still here"))
+	backdated.Time = msgs[0].Time.Add(-time.Hour)
+	if err := backdated.send(store, carol, root); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conv.Hide(carol.UserName(), msgs[0].Name()); err == nil {
+		t.Errorf("reader hid a message")
+	}
+	h, err := conv.Hide(bob.UserName(), msgs[0].Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.send(store, bob, root); err != nil {
+		t.Fatal(err)
+	}
+	unauthorized := NewMessage(carol.UserName(), "plans", h.Name(), bytes.NewBufferString("hid"))
+	unauthorized.Hides = msgs[1].Name()
+	if err := unauthorized.send(store, carol, root); err != nil {
+		t.Fatal(err)
+	}
+	// a hide carol signed claiming to be by the moderator bob
+	forged := NewMessage(carol.UserName(), "plans", unauthorized.Name(), bytes.NewBufferString("hid"))
+	forged.Hides = msgs[2].Name()
+	if _, err := forged.Sign(carol); err != nil {
+		t.Fatal(err)
+	}
+	forged.Author = bob.UserName()
+	if err := forged.send(store, carol, root); err != nil {
+		t.Fatal(err)
+	}
+
+	conv, err = ReadConversation(store, conv.Location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[MsgName]string{
+		msgs[0].Name():   hiddenPlaceholder,
+		msgs[1].Name():   "hi from bob@example.com",
+		msgs[2].Name():   rejectedPlaceholder,
+		backdated.Name(): rejectedPlaceholder,
+	}
+	if len(conv.Messages) != len(want) {
+		t.Fatalf("got %v messages, want %v", len(conv.Messages), len(want))
+	}
+	for _, m := range conv.Messages {
+		if got := m.Content(); got != want[m.Name()] {
+			t.Errorf("message %v has content %q, want %q", m.Name(), got, want[m.Name()])
+		}
+	}
+	report := VerifyConversation(conv, pubkeys.Verify, time.Now())
+	for _, mr := range report.Messages {
+		if failed := len(mr.Errors) > 0; failed != (mr.Name == forged.Name()) {
+			t.Errorf("%v failed verification: %v: %+v", mr.Name, failed, mr)
+		}
+	}
+	for _, mr := range report.Messages {
+		if warned, moderated := len(mr.Warnings) > 0, want[mr.Name] == hiddenPlaceholder || want[mr.Name] == rejectedPlaceholder; warned != moderated {
+			t.Errorf("%v warnings %v, want them only for hidden and rejected messages", mr.Name, mr.Warnings)
+		}
+	}
+}
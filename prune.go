@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"upspin.io/upspin"
+)
+
+const prunedPlaceholder = "*[message pruned]*"
+
+// Retention limits what our copy of a conversation keeps.  Zero fields don't
+// limit anything.
+type Retention struct {
+	// MaxAge prunes messages older than it.
+	MaxAge time.Duration
+	// MaxCount prunes all but the most recent MaxCount messages.
+	MaxCount int
+	// MaxAttachment prunes non-message files larger than it in bytes.
+	MaxAttachment int64
+}
+
+// ParseRetention parses comma-separated retention rules, each one of
+// "maxage=<duration>", "maxcount=<n>" or "maxattachment=<bytes>".
+func ParseRetention(s string) (Retention, error) {
+	var r Retention
+	for _, rule := range splitList(s) {
+		i := strings.Index(rule, "=")
+		if i < 0 {
+			return r, fmt.Errorf("retention rule '%v' missing '='", rule)
+		}
+		name, val := strings.TrimSpace(rule[:i]), strings.TrimSpace(rule[i+1:])
+
+		var err error
+		switch name {
+		case "maxage":
+			r.MaxAge, err = time.ParseDuration(val)
+		case "maxcount":
+			r.MaxCount, err = strconv.Atoi(val)
+		case "maxattachment":
+			r.MaxAttachment, err = strconv.ParseInt(val, 10, 64)
+		default:
+			return r, fmt.Errorf("unknown retention rule '%v'", name)
+		}
+		if err != nil {
+			return r, fmt.Errorf("invalid retention rule '%v': %v", rule, err)
+		}
+	}
+	return r, nil
+}
+
+// IsZero reports whether r doesn't limit anything.
+func (r Retention) IsZero() bool { return r == Retention{} }
+
+// Override returns r with the non-zero rules of o replacing r's.
+func (r Retention) Override(o Retention) Retention {
+	if o.MaxAge != 0 {
+		r.MaxAge = o.MaxAge
+	}
+	if o.MaxCount != 0 {
+		r.MaxCount = o.MaxCount
+	}
+	if o.MaxAttachment != 0 {
+		r.MaxAttachment = o.MaxAttachment
+	}
+	return r
+}
+
+// PrunedMessage records the header fields of a pruned message that keep its
+// place in the conversation.
+type PrunedMessage struct {
+	Author upspin.UserName
+	Time   time.Time
+	Parent MsgName `json:",omitempty"`
+	Title  string
+}
+
+// Prune deletes the messages and attachments of the conversation at convpath
+// that fall outside the retention rules as of now, leaving a pruned
+// tombstone signed with c's key in place of each.  Pruned tombstones aren't
+// synchronized, so pruning only affects our copy, but they stop the pruned
+// files being fetched again and keep the pruned messages' places in the
+// conversation.  It returns the relative paths of the pruned files.
+func Prune(cl upspin.Client, c upspin.Config, convpath upspin.PathName, rules Retention, now time.Time) ([]string, error) {
+	conv, err := ReadConversation(cl, convpath)
+	if err != nil {
+		return nil, err
+	}
+
+	var pruned []string
+	prune := func(rel string, m *PrunedMessage) error {
+		if err := cl.Delete(Join(convpath, rel)); err != nil {
+			return err
+		}
+		t := &Tombstone{Conversation: path.Base(string(convpath)), Path: rel, Deleter: c.UserName(), Time: now, Pruned: true, Message: m}
+		if err := putTombstone(cl, c, convpath, t); err != nil {
+			return err
+		}
+		pruned = append(pruned, rel)
+		return nil
+	}
+
+	var msgs []*Message
+	for _, m := range conv.Messages {
+		if m.File() != "" {
+			msgs = append(msgs, m)
+		}
+	}
+	for i, m := range msgs {
+		tooMany := rules.MaxCount > 0 && i < len(msgs)-rules.MaxCount
+		tooOld := rules.MaxAge > 0 && now.Sub(m.Time) > rules.MaxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		pm := &PrunedMessage{Author: m.Author, Time: m.Time, Parent: m.Parent, Title: m.Title}
+		if err := prune(path.Base(string(m.File())), pm); err != nil {
+			return pruned, fmt.Errorf("failed to prune %v: %v", m.Name(), err)
+		}
+	}
+
+	if rules.MaxAttachment <= 0 {
+		return pruned, nil
+	}
+	ents, err := recursiveList(cl, convpath)
+	if err != nil {
+		return pruned, err
+	}
+	for _, ent := range ents {
+		rel := strings.TrimPrefix(string(ent.SignedName), string(convpath)+"/")
+		if isMsgFile(ent.SignedName) || isMetaFile(ent.SignedName) || rel == "index.html" || rel == feedFile || strings.HasPrefix(rel, tombstoneDir+"/") {
+			continue
+		}
+		if size, err := ent.Size(); err != nil || size <= rules.MaxAttachment {
+			continue
+		}
+		if err := prune(rel, nil); err != nil {
+			return pruned, fmt.Errorf("failed to prune %v: %v", rel, err)
+		}
+	}
+	return pruned, nil
+}
+
+// readPruned adds placeholders for the messages pruned from the conversation
+// by the owner of its directory.  Tombstones that don't verify against the
+// owner's key from ConversationKeys are ignored.
+func (c *Conversation) readPruned(cl upspin.Client) error {
+	if ConversationKeys == nil {
+		return nil
+	}
+	ents, err := cl.Glob(string(Join(c.Location, tombstoneDir, msgPrefix+"*-*."+msgExtension)))
+	if err != nil {
+		return fmt.Errorf("failed to get conversation tombstones: %v", err)
+	} else if len(ents) == 0 {
+		return nil
+	}
+
+	owner := upspin.UserName(strings.SplitN(string(c.Location), "/", 2)[0])
+	have := map[MsgName]bool{}
+	for _, m := range c.Messages {
+		have[m.Name()] = true
+	}
+	for _, ent := range ents {
+		t := prunedTombstone(cl, c.Location, ent.SignedName, owner, ConversationKeys)
+		if t == nil {
+			continue
+		}
+		pm := t.Message
+		m := &Message{Author: pm.Author, Title: pm.Title, Time: pm.Time, Parent: pm.Parent, pruned: true}
+		if m.Name() != MsgName(path.Base(string(ent.SignedName))) || have[m.Name()] {
+			continue
+		}
+		have[m.Name()] = true
+		c.Messages = append(c.Messages, m)
+	}
+	return nil
+}
+
+// prunedTombstone returns the pruned message tombstone at p in the
+// conversation at convpath, or nil if it can't be read or doesn't verify as
+// written by owner with owner's key as returned by keyFor.
+func prunedTombstone(cl upspin.Client, convpath, p upspin.PathName, owner upspin.UserName, keyFor func(upspin.UserName) (upspin.PublicKey, error)) *Tombstone {
+	data, err := cl.Get(p)
+	if err != nil {
+		return nil
+	}
+	t := &Tombstone{}
+	if err := json.Unmarshal(data, t); err != nil || !t.Pruned || t.Message == nil || t.Deleter != owner {
+		return nil
+	}
+	if t.Path != path.Base(string(p)) || t.Conversation != path.Base(string(convpath)) {
+		return nil
+	}
+	if key, err := keyFor(owner); err != nil || t.Verify(key) != nil {
+		return nil
+	}
+	return t
+}
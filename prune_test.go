@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRetention(t *testing.T) {
+	r, err := ParseRetention("maxage=720h, maxcount=100,maxattachment=4096")
+	if err != nil {
+		t.Fatal(err)
+	} else if want := (Retention{MaxAge: 720 * time.Hour, MaxCount: 100, MaxAttachment: 4096}); r != want {
+		t.Errorf("got %+v, want %+v", r, want)
+	}
+	for _, bad := range []string{"maxage", "maxage=soon", "maxcount=x", "keep=all"} {
+		if _, err := ParseRetention(bad); err == nil {
+			t.Errorf("invalid rules %q parsed without error", bad)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	store := newMemClient()
+	alice := newTestConfig(t, "alice@example.com")
+	bob := newTestConfig(t, "bob@example.com")
+	convpath := ConvPath(alice.UserName(), "plans")
+	dst := ConvPath("carol@example.com", "plans")
+	keys := TrustedKeys{alice.UserName(): alice.f.PublicKey(), bob.UserName(): bob.f.PublicKey()}
+	useKeys(t, keys)
+
+	conv := NewConversation(DefaultRoot(alice.UserName()), "plans")
+	var msgs []*Message
+	for i, c := range []*testConfig{alice, bob, alice} {
+		m := conv.Add(c.UserName(), bytes.NewBufferString(strings.Repeat("x", i+1)))
+		if err := m.send(store, c, DefaultRoot(alice.UserName())); err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, m)
+	}
+	for name, size := range map[string]int{"big.pdf": 100, "small.txt": 5} {
+		if _, err := store.Put(Join(convpath, name), make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Syncer{Client: store, Keys: keys.Key}
+	if _, err := s.Sync(convpath, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := Prune(store, alice, convpath, Retention{MaxCount: 1, MaxAttachment: 10}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{string(msgs[0].Name()), string(msgs[1].Name()), "big.pdf"}
+	if !reflect.DeepEqual(pruned, want) {
+		t.Errorf("pruned %v, want %v", pruned, want)
+	}
+
+	conv, err = ReadConversation(store, convpath)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(conv.Messages) != 3 {
+		t.Fatalf("got %v messages, want 3", len(conv.Messages))
+	}
+	for i, m := range conv.Messages {
+		if m.Name() != msgs[i].Name() {
+			t.Errorf("message %v is %v, want %v", i, m.Name(), msgs[i].Name())
+		}
+		if pruned := i < 2; m.IsPruned() != pruned || (m.Content() == prunedPlaceholder) != pruned {
+			t.Errorf("message %v has pruned %v and content %q", i, m.IsPruned(), m.Content())
+		}
+	}
+	if next := conv.nextParent(); next != msgs[2].Name() {
+		t.Errorf("next parent is %v, want %v", next, msgs[2].Name())
+	}
+
+	report := VerifyConversation(conv, keys.Verify, time.Now())
+	if report.Failed() {
+		t.Errorf("pruned conversation fails verification: %+v", report.Messages)
+	} else if report.Messages[0].Signature != "pruned" {
+		t.Errorf("pruned message reported as %v", report.Messages[0].Signature)
+	}
+
+	data, err := store.Get(Join(convpath, tombstoneDir, "big.pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ts Tombstone
+	if err := json.Unmarshal(data, &ts); err != nil {
+		t.Fatal(err)
+	} else if err := ts.Verify(alice.f.PublicKey()); err != nil {
+		t.Errorf("tombstone doesn't verify: %v", err)
+	} else if err := ts.Verify(bob.f.PublicKey()); err == nil {
+		t.Errorf("tombstone verified with wrong key")
+	}
+
+	// Pruning doesn't reach other copies and pruned files aren't fetched
+	// again.
+	if _, err := s.Sync(convpath, dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Lookup(Join(dst, string(msgs[0].Name())), false); err != nil {
+		t.Errorf("pruning deleted carol's copy: %v", err)
+	}
+	if r, err := s.Sync(dst, convpath); err != nil {
+		t.Fatal(err)
+	} else if len(r.Copied) != 0 {
+		t.Errorf("pruned files fetched again: %v", r.Copied)
+	}
+	if _, err := store.Lookup(Join(convpath, "big.pdf"), false); err == nil {
+		t.Errorf("pruned attachment fetched again")
+	}
+
+	// A pruned tombstone not signed by the directory's owner is ignored.
+	pm := &PrunedMessage{Author: alice.UserName(), Time: msgs[0].Time, Title: "plans"}
+	forged := &Tombstone{Conversation: "plans", Path: string(msgs[0].Name()), Deleter: alice.UserName(), Time: time.Now(), Pruned: true, Message: pm}
+	if err := putTombstone(store, bob, convpath, forged); err != nil {
+		t.Fatal(err)
+	}
+	if conv, err := ReadConversation(store, convpath); err != nil {
+		t.Fatal(err)
+	} else if len(conv.Messages) != 2 {
+		t.Errorf("forged tombstone left a placeholder: %v", conv.Messages)
+	}
+	if r, err := s.Sync(dst, convpath); err != nil {
+		t.Fatal(err)
+	} else if len(r.Copied) != 1 || r.Copied[0] != Join(convpath, string(msgs[0].Name())) {
+		t.Errorf("message behind forged tombstone not fetched: %v", r.Copied)
+	}
+}
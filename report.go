@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"upspin.io/upspin"
+)
+
+// maxClockSkew is how far in the future a message timestamp may be before it
+// is reported.
+const maxClockSkew = 5 * time.Minute
+
+// MsgReport holds the results of checking a single message.
+type MsgReport struct {
+	Name MsgName
+	File upspin.PathName
+	// Signature describes the signature status: "ok", "superseded key",
+	// "retracted" (for removed messages), "pruned" or "FAILED".
+	Signature string
+	// Errors hold failed checks and Warnings hold suspicious but acceptable
+	// findings (such as another participant's message with the same number).
+	Errors   []string
+	Warnings []string
+}
+
+// Report holds the results of checking every message in a conversation.
+type Report struct {
+	Conversation upspin.PathName
+	Messages     []*MsgReport
+}
+
+// Failed reports whether any message failed a check.
+func (r *Report) Failed() bool {
+	for _, mr := range r.Messages {
+		if len(mr.Errors) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyConversation checks every message in conv: its signature (using
+// verify), that its author matches the user in its file name, that its file
+// name matches its name, that its title matches the conversation directory,
+// that its parent exists, that its number is unique and that its timestamp
+// isn't in the future relative to now.
+func VerifyConversation(conv *Conversation, verify func(*Message) error, now time.Time) *Report {
+	r := &Report{Conversation: conv.Location}
+	dirTitle := path.Base(string(conv.Location))
+
+	msgs := append(append([]*Message{}, conv.Messages...), conv.Retractions...)
+	names := map[MsgName]bool{}
+	numbers := map[int]int{}
+	for _, m := range msgs {
+		names[m.Name()] = true
+		numbers[m.Name().Number()]++
+	}
+
+	for _, m := range msgs {
+		mr := &MsgReport{Name: m.Name(), File: m.File(), Signature: "ok"}
+		r.Messages = append(r.Messages, mr)
+		if m.IsRetracted() && !m.IsSigned() {
+			mr.Signature = "retracted"
+			continue // placeholder for a removed message
+		} else if m.IsPruned() {
+			mr.Signature = "pruned"
+			continue
+		}
+
+		mr.checkSignature(m, verify)
+
+		if m.File() != "" {
+			fname := MsgName(path.Base(string(m.File())))
+			if fname.User() != m.Author {
+				mr.Errors = append(mr.Errors, fmt.Sprintf("author %v differs from file name user %v", m.Author, fname.User()))
+			} else if fname != m.Name() {
+				mr.Errors = append(mr.Errors, fmt.Sprintf("file name differs from message name %v", m.Name()))
+			}
+		}
+		if m.Title != dirTitle {
+			mr.Errors = append(mr.Errors, fmt.Sprintf("title '%v' differs from conversation directory '%v'", m.Title, dirTitle))
+		}
+		if m.Parent != "" && !names[m.Parent] {
+			mr.Errors = append(mr.Errors, fmt.Sprintf("parent %v is missing", m.Parent))
+		}
+		if n := numbers[m.Name().Number()]; n > 1 {
+			mr.Warnings = append(mr.Warnings, fmt.Sprintf("%v messages share number %v", n, m.Name().Number()))
+		}
+		if m.Time.After(now.Add(maxClockSkew)) {
+			mr.Errors = append(mr.Errors, fmt.Sprintf("timestamp %v is in the future", m.Time.Format(time.UnixDate)))
+		}
+		if m.rejected {
+			mr.Warnings = append(mr.Warnings, fmt.Sprintf("%v's role doesn't permit posting", m.Author))
+		} else if m.hidden {
+			mr.Warnings = append(mr.Warnings, "hidden by a moderator")
+		}
+	}
+	return r
+}
+
+// VerifyPayload checks the signature and timestamp of a standalone message
+// payload read from r.  Payloads that can't be parsed are reported as
+// failures under the given file name.
+func VerifyPayload(fname string, r io.Reader, verify func(*Message) error, now time.Time) *MsgReport {
+	m, err := ParseMessage(r)
+	if err != nil {
+		return &MsgReport{Name: MsgName(fname), Signature: "FAILED", Errors: []string{"malformed: " + err.Error()}}
+	}
+
+	mr := &MsgReport{Name: m.Name(), File: upspin.PathName(fname), Signature: "ok"}
+	mr.checkSignature(m, verify)
+	if m.Time.After(now.Add(maxClockSkew)) {
+		mr.Errors = append(mr.Errors, fmt.Sprintf("timestamp %v is in the future", m.Time.Format(time.UnixDate)))
+	}
+	return mr
+}
+
+// checkSignature records the result of verifying m's signature.  Signatures
+// by superseded keys are only a warning.
+func (mr *MsgReport) checkSignature(m *Message, verify func(*Message) error) {
+	if err := verify(m); err != nil {
+		if _, ok := err.(*SupersededKeyError); ok {
+			mr.Signature = "superseded key"
+			mr.Warnings = append(mr.Warnings, err.Error())
+		} else {
+			mr.Signature = "FAILED"
+			mr.Errors = append(mr.Errors, "bad signature: "+err.Error())
+		}
+	}
+}
+
+// Print writes the report to w as a table followed by a summary line.
+func (r *Report) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "MESSAGE\tSIGNATURE\tSTATUS\tPROBLEMS\n")
+
+	failed, warned := 0, 0
+	for _, mr := range r.Messages {
+		status := "ok"
+		if len(mr.Errors) > 0 {
+			status = "FAILED"
+			failed++
+		} else if len(mr.Warnings) > 0 {
+			status = "warning"
+			warned++
+		}
+		problems := append(append([]string{}, mr.Errors...), mr.Warnings...)
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", mr.Name, mr.Signature, status, strings.Join(problems, "; "))
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\n%v messages: %v failed, %v with warnings\n", len(r.Messages), failed, warned)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"upspin.io/upspin"
+)
+
+func TestVerifyConversation(t *testing.T) {
+	now := time.Now()
+	conv := NewConversation(DefaultRoot("alice@example.com"), "plans")
+	add := func(author, title string, parent MsgName, file string) *Message {
+		m := NewMessage(upspin.UserName(author), title, parent, bytes.NewBufferString(""))
+		m.file = Join(conv.Location, file)
+		conv.Messages = append(conv.Messages, m)
+		return m
+	}
+
+	good := add("alice@example.com", "plans", "", "msg1-alice@example.com.txt")
+	dup := add("bob@example.com", "plans", "", "msg1-bob@example.com.txt")
+	retitled := add("bob@example.com", "other", good.Name(), "msg2-bob@example.com.txt")
+	orphan := add("carol@example.com", "plans", "msg7-dave@example.com.txt", "msg8-carol@example.com.txt")
+	future := add("alice@example.com", "plans", orphan.Name(), "msg9-alice@example.com.txt")
+	future.Time = now.Add(time.Hour)
+	forged := add("mallory@example.com", "plans", future.Name(), "msg10-alice@example.com.txt")
+
+	r := VerifyConversation(conv, func(m *Message) error {
+		if m == forged {
+			return errors.New("signature verification failed")
+		}
+		return nil
+	}, now)
+
+	if !r.Failed() {
+		t.Error("report with failures doesn't fail")
+	}
+
+	want := map[*Message][]string{
+		good:     {"share number 1"},
+		dup:      {"share number 1"},
+		retitled: {"title 'other' differs"},
+		orphan:   {"parent msg7-dave@example.com.txt is missing"},
+		future:   {"in the future"},
+		forged:   {"bad signature", "differs from file name user alice@example.com"},
+	}
+	for i, m := range conv.Messages {
+		mr := r.Messages[i]
+		problems := strings.Join(append(mr.Errors, mr.Warnings...), "; ")
+		for _, p := range want[m] {
+			if !strings.Contains(problems, p) {
+				t.Errorf("%v: want problem %q, got %q", m.Name(), p, problems)
+			}
+		}
+	}
+	if len(r.Messages[0].Errors) != 0 {
+		t.Errorf("duplicate number reported as error: %v", r.Messages[0].Errors)
+	}
+
+	var buf bytes.Buffer
+	r.Print(&buf)
+	if !strings.Contains(buf.String(), "6 messages: 4 failed, 2 with warnings") {
+		t.Errorf("bad report summary:\n%v", buf.String())
+	}
+}
+
+func TestVerifyPayload(t *testing.T) {
+	alice := newTestConfig(t, "alice@example.com")
+	verify := func(m *Message) error { return m.verifyKey(alice.f.PublicKey()) }
+
+	m := NewMessage(alice.UserName(), "plans", "", bytes.NewBufferString("hi"))
+	payload, err := m.Sign(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		payload string
+		failed  bool
+	}{
+		{payload, false},
+		{strings.Replace(payload, "hi", "ho", 1), true},
+		{"not a message", true},
+	}
+	for i, test := range tests {
+		r := &Report{Messages: []*MsgReport{VerifyPayload("-", strings.NewReader(test.payload), verify, time.Now())}}
+		if r.Failed() != test.failed {
+			t.Errorf("payload %v: failed=%v, want %v: %+v", i, r.Failed(), test.failed, r.Messages[0])
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"upspin.io/access"
+	"upspin.io/upspin"
+)
+
+// Settings holds per-user converse preferences read from the converse config
+// file.  Command line flags override them.
+//
+// The file consists of "key: value" lines; blank lines and lines starting
+// with '#' are ignored.  Keys are:
+//
+//	root:         root conversations directory
+//	state:        directory for local converse state
+//	to:           comma-separated default recipients for send
+//	editor:       command used to compose messages
+//	format:       default output format for show ("text" or "html")
+//	hook:         shell command run for each newly synchronized message
+//	              (may be repeated)
+//	syncinterval: interval between daemon synchronizations (e.g. "5m")
+//	template:     html/template file used to render conversations as html
+//	alias:        "name = recipient, ..." defining a local alias for a list of
+//	              users, upspin Group files or other aliases (may be repeated)
+//	retention:    comma-separated retention rules (see ParseRetention)
+//	              enforced by prune and the daemon
+//
+// Keys of the form "retention <title>" set retention rules for a single
+// conversation, overriding the global rules they set.
+type Settings struct {
+	Root         string
+	StateDir     string
+	To           []string
+	Editor       string
+	Format       string
+	Hooks        []string
+	SyncInterval time.Duration
+	Template     string
+	Aliases      map[string][]string
+	Retention    Retention
+	// ConvRetention holds per-conversation retention rules by title.
+	ConvRetention map[string]Retention
+}
+
+// LoadSettings reads settings from the file fname.  A missing file yields
+// empty settings.
+func LoadSettings(fname string) (*Settings, error) {
+	f, err := os.Open(fname)
+	if os.IsNotExist(err) {
+		return &Settings{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s, err := ParseSettings(f)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", fname, err)
+	}
+	return s, nil
+}
+
+func ParseSettings(r io.Reader) (*Settings, error) {
+	s := &Settings{}
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("line %v: missing ':'", lineno)
+		}
+		key, val := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+
+		switch key {
+		case "root":
+			s.Root = val
+		case "state":
+			s.StateDir = val
+		case "to":
+			s.To = splitList(val)
+		case "editor":
+			s.Editor = val
+		case "format":
+			if val != "text" && val != "html" {
+				return nil, fmt.Errorf("line %v: unknown format '%v'", lineno, val)
+			}
+			s.Format = val
+		case "hook":
+			s.Hooks = append(s.Hooks, val)
+		case "syncinterval":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %v", lineno, err)
+			}
+			s.SyncInterval = d
+		case "template":
+			s.Template = val
+		case "alias":
+			i := strings.Index(val, "=")
+			if i < 0 {
+				return nil, fmt.Errorf("line %v: alias missing '='", lineno)
+			}
+			name := strings.TrimSpace(val[:i])
+			if name == "" || strings.ContainsAny(name, "@/") {
+				return nil, fmt.Errorf("line %v: invalid alias name '%v'", lineno, name)
+			}
+			if s.Aliases == nil {
+				s.Aliases = map[string][]string{}
+			}
+			s.Aliases[name] = splitList(val[i+1:])
+		case "retention":
+			r, err := ParseRetention(val)
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %v", lineno, err)
+			}
+			s.Retention = r
+		default:
+			if title := strings.TrimPrefix(key, "retention "); title != key {
+				r, err := ParseRetention(val)
+				if err != nil {
+					return nil, fmt.Errorf("line %v: %v", lineno, err)
+				}
+				if s.ConvRetention == nil {
+					s.ConvRetention = map[string]Retention{}
+				}
+				s.ConvRetention[strings.TrimSpace(title)] = r
+				continue
+			}
+			return nil, fmt.Errorf("line %v: unknown setting '%v'", lineno, key)
+		}
+	}
+	return s, scanner.Err()
+}
+
+// Recipients expands aliases in a list of recipients, returning the named
+// users and upspin Group files.
+func (s *Settings) Recipients(recipients []string) (users []upspin.UserName, groups []upspin.PathName, err error) {
+	seen := map[string]bool{}
+	var expand func(names []string) error
+	expand = func(names []string) error {
+		for _, name := range names {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			switch {
+			case strings.Contains(name, "/"):
+				if !access.IsGroupFile(upspin.PathName(name)) {
+					return fmt.Errorf("recipient %v is not a Group file", name)
+				}
+				groups = append(groups, upspin.PathName(name))
+			case strings.Contains(name, "@"):
+				users = append(users, upspin.UserName(name))
+			default:
+				members, ok := s.Aliases[name]
+				if !ok {
+					return fmt.Errorf("unknown recipient alias '%v'", name)
+				}
+				if err := expand(members); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	err = expand(recipients)
+	return users, groups, err
+}
+
+// RetentionFor returns the retention rules for the conversation with the
+// given title.
+func (s *Settings) RetentionFor(title string) Retention {
+	return s.Retention.Override(s.ConvRetention[title])
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
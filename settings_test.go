@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"upspin.io/upspin"
+)
+
+func TestParseSettings(t *testing.T) {
+	const conf = `
+# converse settings
+root: talk
+to: alice@example.com, bob@example.com
+editor: nano
+format: html
+hook: notify-send new message
+hook: logger converse
+syncinterval: 10m
+template: $HOME/upspin/conv.tmpl
+retention: maxage=2160h, maxattachment=1048576
+retention plans: maxcount=50
+`
+	s, err := ParseSettings(bytes.NewBufferString(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &Settings{
+		Root:          "talk",
+		To:            []string{"alice@example.com", "bob@example.com"},
+		Editor:        "nano",
+		Format:        "html",
+		Hooks:         []string{"notify-send new message", "logger converse"},
+		SyncInterval:  10 * time.Minute,
+		Template:      "$HOME/upspin/conv.tmpl",
+		Retention:     Retention{MaxAge: 2160 * time.Hour, MaxAttachment: 1 << 20},
+		ConvRetention: map[string]Retention{"plans": {MaxCount: 50}},
+	}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("want settings %+v, got %+v", want, s)
+	}
+	if got, want := s.RetentionFor("plans"), (Retention{MaxAge: 2160 * time.Hour, MaxCount: 50, MaxAttachment: 1 << 20}); got != want {
+		t.Errorf("want plans retention %+v, got %+v", want, got)
+	}
+
+	for _, bad := range []string{"color: blue", "format: pdf", "syncinterval: often", "root", "retention: maxage=forever", "retention plans: keep=all"} {
+		if _, err := ParseSettings(bytes.NewBufferString(bad)); err == nil {
+			t.Errorf("invalid setting %q parsed without error", bad)
+		}
+	}
+}
+
+func TestRecipients(t *testing.T) {
+	s, err := ParseSettings(bytes.NewBufferString(`
+alias: eng = alice@example.com, eng-lead@example.com/Group/eng
+alias: all = eng, bob@example.com, all
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, groups, err := s.Recipients([]string{"all", "carol@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantUsers := []upspin.UserName{"alice@example.com", "bob@example.com", "carol@example.com"}
+	wantGroups := []upspin.PathName{"eng-lead@example.com/Group/eng"}
+	if !reflect.DeepEqual(users, wantUsers) || !reflect.DeepEqual(groups, wantGroups) {
+		t.Errorf("want %v and %v, got %v and %v", wantUsers, wantGroups, users, groups)
+	}
+
+	if _, _, err := s.Recipients([]string{"nobody"}); err == nil {
+		t.Error("unknown alias expanded without error")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"upspin.io/upspin"
+)
+
+// NewStandupBot returns an example bot that collects daily standup notes.
+// Its one command is "/standup-report", to which it replies with each
+// participant's latest notes for that day: the text of their messages that
+// day starting with "/standup ".
+func NewStandupBot(cfg upspin.Config, cl upspin.Client, root upspin.PathName) *Bot {
+	b := NewBot(cfg, cl, root)
+	b.Command("standup-report", standupReport)
+	return b
+}
+
+func standupReport(r *Request) error {
+	loc := r.Msg.Time.Location()
+	year, month, day := r.Msg.Time.Date()
+
+	var order []string
+	notes := map[string]string{}
+	for _, m := range r.Conv.Messages {
+		content := strings.TrimSpace(m.Content())
+		fields := strings.Fields(content)
+		if len(fields) < 2 || fields[0] != "/standup" {
+			continue
+		}
+		if y, mo, d := m.Time.In(loc).Date(); y != year || mo != month || d != day {
+			continue
+		}
+
+		from := m.From()
+		if _, ok := notes[from]; !ok {
+			order = append(order, from)
+		}
+		notes[from] = strings.TrimSpace(strings.TrimPrefix(content, "/standup"))
+	}
+
+	date := r.Msg.Time.Format("Mon Jan 2 2006")
+	if len(order) == 0 {
+		return r.Reply(fmt.Sprintf("No standup notes for %v.", date))
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Standup for %v:\n\n", date)
+	for _, from := range order {
+		fmt.Fprintf(&buf, "* **%v**: %v\n", from, notes[from])
+	}
+	return r.Reply(buf.String())
+}
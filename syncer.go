@@ -0,0 +1,533 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"upspin.io/factotum"
+	"upspin.io/upspin"
+)
+
+// quarantineDir is the hidden directory within a conversation that holds
+// files rejected during synchronization.
+const quarantineDir = ".quarantine"
+
+// AttachmentPolicy controls how a Syncer treats files that aren't messages.
+type AttachmentPolicy int
+
+const (
+	// AttachAllow copies attachments unchecked.
+	AttachAllow AttachmentPolicy = iota
+	// AttachSkip ignores attachments.
+	AttachSkip
+	// AttachQuarantine copies attachments into the quarantine directory.
+	AttachQuarantine
+)
+
+func ParseAttachmentPolicy(s string) (AttachmentPolicy, error) {
+	switch s {
+	case "allow":
+		return AttachAllow, nil
+	case "skip":
+		return AttachSkip, nil
+	case "quarantine":
+		return AttachQuarantine, nil
+	}
+	return 0, fmt.Errorf("unknown attachment policy '%v'", s)
+}
+
+// tombstoneDir is the directory within a conversation that records deleted
+// files.
+const tombstoneDir = "tombstones"
+
+// ConflictPolicy controls how a Syncer treats files that differ from (or
+// have been deleted relative to) the destination's copy.
+type ConflictPolicy int
+
+const (
+	// ConflictAuthor accepts revisions and deletions of a message or
+	// metadata file only from its author's copy.  Other changes are
+	// quarantined.
+	ConflictAuthor ConflictPolicy = iota
+	// ConflictKeep never changes existing files.  Changes are quarantined.
+	ConflictKeep
+	// ConflictTheirs accepts revisions and deletions from any participant.
+	ConflictTheirs
+)
+
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch s {
+	case "author":
+		return ConflictAuthor, nil
+	case "keep":
+		return ConflictKeep, nil
+	case "theirs":
+		return ConflictTheirs, nil
+	}
+	return 0, fmt.Errorf("unknown conflict policy '%v'", s)
+}
+
+// Tombstone records the deletion of a file from a conversation.  It is
+// stored beneath the conversation's tombstone directory at the deleted file's
+// relative path and is synchronized like other files so that the deletion
+// reaches every participant.  Tombstones are signed by their Deleter.
+type Tombstone struct {
+	// Conversation is the title of the conversation holding the file.
+	Conversation string
+	Path         string
+	Deleter      upspin.UserName
+	Time         time.Time
+	// Pruned is set for files removed by a retention policy (see Prune).
+	// Pruning only affects the pruner's copy so pruned tombstones aren't
+	// synchronized.
+	Pruned bool `json:",omitempty"`
+	// Message holds a pruned message's place in the conversation.
+	Message *PrunedMessage `json:",omitempty"`
+	// R and S hold the hex encoded signature by Deleter.
+	R, S string
+}
+
+// canonical returns the bytes signed for a tombstone, using the encoding
+// described for messages with its own magic line and fields.
+func (t *Tombstone) canonical() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("converse tombstone\n")
+	writeField(&buf, "conversation", t.Conversation)
+	writeField(&buf, "path", t.Path)
+	writeField(&buf, "deleter", string(t.Deleter))
+	writeField(&buf, "time", t.Time.UTC().Format(time.RFC3339Nano))
+	writeField(&buf, "pruned", strconv.FormatBool(t.Pruned))
+	if m := t.Message; m != nil {
+		writeField(&buf, "message.author", string(m.Author))
+		writeField(&buf, "message.time", m.Time.UTC().Format(time.RFC3339Nano))
+		writeField(&buf, "message.parent", string(m.Parent))
+		writeField(&buf, "message.title", m.Title)
+	}
+	return buf.Bytes()
+}
+
+// Sign signs the tombstone with c's key.
+func (t *Tombstone) Sign(c upspin.Config) error {
+	h := sha256.Sum256(t.canonical())
+	sig, err := c.Factotum().Sign(h[:])
+	if err != nil {
+		return err
+	}
+	t.R, t.S = fmt.Sprintf("%x", sig.R), fmt.Sprintf("%x", sig.S)
+	return nil
+}
+
+// Verify checks the tombstone's signature against key.
+func (t *Tombstone) Verify(key upspin.PublicKey) error {
+	sig, err := parseSig(t.R, t.S)
+	if err != nil {
+		return err
+	}
+	h := sha256.Sum256(t.canonical())
+	return factotum.Verify(h[:], sig, key)
+}
+
+// putTombstone signs t with c's key and stores it in the conversation at
+// convpath.
+func putTombstone(cl upspin.Client, c upspin.Config, convpath upspin.PathName, t *Tombstone) error {
+	if err := t.Sign(c); err != nil {
+		return err
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	tpath := Join(convpath, tombstoneDir, t.Path)
+	if err := MakeDirs(cl, upspin.PathName(path.Dir(string(tpath)))); err != nil {
+		return err
+	}
+	_, err = cl.Put(tpath, data)
+	return err
+}
+
+// Remove deletes the file at rel within the conversation at convpath and
+// leaves a tombstone signed with c's key in its place.
+func Remove(cl upspin.Client, c upspin.Config, convpath upspin.PathName, rel string) error {
+	if err := cl.Delete(Join(convpath, rel)); err != nil {
+		return err
+	}
+	t := &Tombstone{Conversation: path.Base(string(convpath)), Path: rel, Deleter: c.UserName(), Time: time.Now()}
+	return putTombstone(cl, c, convpath, t)
+}
+
+// Quarantined records a file that was rejected during synchronization.
+type Quarantined struct {
+	Src, Dst upspin.PathName
+	Reason   string
+}
+
+// SyncResult describes the outcome of synchronizing one source directory.
+type SyncResult struct {
+	// Copied holds the destination paths of newly copied files.
+	Copied []upspin.PathName
+	// Updated holds the destination paths of files replaced by a revision.
+	Updated []upspin.PathName
+	// Deleted holds the destination paths of files removed by a tombstone.
+	Deleted     []upspin.PathName
+	Quarantined []Quarantined
+	// Skipped holds the source paths of attachments ignored by policy.
+	Skipped []upspin.PathName
+}
+
+// Cursor records the state of a source directory when it was last
+// synchronized.
+type Cursor struct {
+	// DirSeq is the sequence number of the source directory itself, which
+	// changes whenever anything beneath it changes.
+	DirSeq int64
+	// Seqs holds the sequence number of each source file.
+	Seqs map[upspin.PathName]int64
+}
+
+// Syncer copies files from a participant's conversation directory into ours.
+type Syncer struct {
+	Client upspin.Client
+	// Verify, if non-nil, checks each incoming message.  Messages that fail
+	// to parse, fail verification, are stored under a file name other than
+	// their own or belong to another conversation are quarantined instead
+	// of copied.  A *KeyLookupError from Verify fails the sync instead, so
+	// that the message is checked again next time.
+	Verify      func(*Message) error
+	Attachments AttachmentPolicy
+	Conflicts   ConflictPolicy
+	// Keys looks up the public keys that tombstones and metadata files are
+	// verified with.  A deletion is only accepted if its tombstone is signed
+	// by the deleted file's author, so none are accepted if Keys is nil.
+	// Metadata files that fail verification or describe another
+	// conversation are quarantined; they're copied unchecked if Keys is nil.
+	Keys func(upspin.UserName) (upspin.PublicKey, error)
+	// Cursors, if non-nil, holds a cursor per source directory so that
+	// unchanged directories and files are skipped on later syncs.  Sync
+	// creates and updates cursors as it goes.
+	Cursors map[upspin.PathName]*Cursor
+	// Full ignores (but still updates) cursors.
+	Full bool
+
+	mu sync.Mutex // guards Cursors
+}
+
+// Sync copies files from src that don't exist in dst yet.  Rejected files are
+// copied into dst's quarantine directory under the source user's name.  Sync
+// may be called concurrently for different sources.
+func (s *Syncer) Sync(src, dst upspin.PathName) (*SyncResult, error) {
+	r := &SyncResult{}
+
+	var cur *Cursor
+	var dirSeq int64
+	if s.Cursors != nil {
+		dir, err := s.Client.Lookup(src, false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve src directory: %v", err)
+		}
+		dirSeq = dir.Sequence
+
+		s.mu.Lock()
+		cur = s.Cursors[src]
+		unchanged := cur != nil && !s.Full && cur.DirSeq == dirSeq && dirSeq != 0
+		if cur == nil || s.Full {
+			cur = &Cursor{Seqs: map[upspin.PathName]int64{}}
+			s.Cursors[src] = cur
+		}
+		s.mu.Unlock()
+		if unchanged {
+			return r, nil // nothing changed
+		}
+	}
+
+	srcs, err := recursiveList(s.Client, src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve src files: %v", err)
+	}
+
+	srcUser := strings.SplitN(string(src), "/", 2)[0]
+	for _, ent := range srcs {
+		srcpath := ent.SignedName
+		if cur != nil && cur.Seqs[srcpath] == ent.Sequence && ent.Sequence != 0 {
+			continue // unchanged since last sync
+		}
+
+		if err := s.syncFile(r, srcUser, src, dst, srcpath); err != nil {
+			return r, err
+		}
+		if cur != nil {
+			cur.Seqs[srcpath] = ent.Sequence
+		}
+	}
+
+	if cur != nil {
+		cur.DirSeq = dirSeq
+	}
+	return r, nil
+}
+
+// syncFile copies the file at srcpath beneath src to the corresponding path
+// beneath dst, or into the quarantine directory, recording the outcome in r.
+// Files that differ from the destination's copy are revisions and tombstones
+// delete the destination's copy of a file, both subject to the conflict
+// policy.
+func (s *Syncer) syncFile(r *SyncResult, srcUser string, src, dst, srcpath upspin.PathName) error {
+	rel := strings.TrimPrefix(string(srcpath), string(src)+"/")
+	dstpath := Join(dst, rel)
+	qpath := Join(dst, quarantineDir, srcUser, rel)
+
+	if strings.HasPrefix(rel, tombstoneDir+"/") {
+		return s.syncTombstone(r, srcUser, dst, srcpath, strings.TrimPrefix(rel, tombstoneDir+"/"))
+	}
+	if deleted, err := s.deletedAt(dst, rel); err != nil {
+		return err
+	} else if deleted {
+		return nil
+	}
+
+	data, err := s.Client.Get(srcpath)
+	if err != nil {
+		return err
+	}
+	revision := false
+	if _, err := s.Client.Lookup(dstpath, false); err == nil {
+		old, err := s.Client.Get(dstpath)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		if sum == sha256.Sum256(old) {
+			return nil // file exists at destination already
+		}
+		// quarantined revisions are kept apart by their content hash
+		revision = true
+		qpath = upspin.PathName(fmt.Sprintf("%v.%x", qpath, sum[:4]))
+	}
+	if _, err := s.Client.Lookup(qpath, false); err == nil {
+		return nil // already quarantined
+	}
+
+	var reason string
+	if revision && !s.accepts(srcUser, rel) {
+		reason = "conflicting revision rejected by policy"
+	} else if !isMsgFile(srcpath) && !isMetaFile(srcpath) {
+		if s.Attachments == AttachSkip {
+			r.Skipped = append(r.Skipped, srcpath)
+			return nil
+		} else if s.Attachments == AttachQuarantine {
+			reason = "attachment quarantined by policy"
+		}
+	} else if isMetaFile(srcpath) {
+		if s.Keys != nil {
+			if reason, err = s.checkMeta(srcpath, dst, data); err != nil {
+				return err
+			}
+		}
+	} else if s.Verify != nil {
+		if reason, err = s.check(srcpath, dst, data); err != nil {
+			return err
+		}
+	}
+
+	if reason != "" {
+		if err := s.put(qpath, data); err != nil {
+			return err
+		}
+		r.Quarantined = append(r.Quarantined, Quarantined{Src: srcpath, Dst: qpath, Reason: reason})
+		return nil
+	}
+
+	if err := s.put(dstpath, data); err != nil {
+		return err
+	}
+	if revision {
+		r.Updated = append(r.Updated, dstpath)
+	} else {
+		r.Copied = append(r.Copied, dstpath)
+	}
+	return nil
+}
+
+// syncTombstone deletes the destination's copy of the file at rel according
+// to the tombstone at srcpath and copies the tombstone to the destination.
+func (s *Syncer) syncTombstone(r *SyncResult, srcUser string, dst, srcpath upspin.PathName, rel string) error {
+	tpath := Join(dst, tombstoneDir, rel)
+	if _, err := s.Client.Lookup(tpath, false); err == nil {
+		return nil // deletion already applied
+	}
+	data, err := s.Client.Get(srcpath)
+	if err != nil {
+		return err
+	}
+	var t Tombstone
+	var reason string
+	if err := json.Unmarshal(data, &t); err != nil {
+		reason = fmt.Sprintf("malformed tombstone: %v", err)
+	} else if t.Pruned {
+		return nil // pruned from the source's copy only
+	} else if !s.accepts(srcUser, rel) {
+		reason = "deletion rejected by policy"
+	} else if reason, err = s.checkTombstone(&t, srcUser, dst, rel); err != nil {
+		return err
+	}
+
+	dstpath := Join(dst, rel)
+	if reason != "" {
+		if _, err := s.Client.Lookup(dstpath, false); err != nil {
+			return nil // nothing to delete
+		}
+		qpath := Join(dst, quarantineDir, srcUser, tombstoneDir, rel)
+		if _, err := s.Client.Lookup(qpath, false); err == nil {
+			return nil // already quarantined
+		}
+		if err := s.put(qpath, data); err != nil {
+			return err
+		}
+		r.Quarantined = append(r.Quarantined, Quarantined{Src: srcpath, Dst: qpath, Reason: reason})
+		return nil
+	}
+
+	if _, err := s.Client.Lookup(dstpath, false); err == nil {
+		if err := s.Client.Delete(dstpath); err != nil {
+			return err
+		}
+		r.Deleted = append(r.Deleted, dstpath)
+	}
+	return s.put(tpath, data)
+}
+
+// deletedAt reports whether the conversation at dst holds a tombstone for the
+// file at rel that verifies, either pruned by dst's owner or signed by the
+// file's author.
+func (s *Syncer) deletedAt(dst upspin.PathName, rel string) (bool, error) {
+	data, err := s.Client.Get(Join(dst, tombstoneDir, rel))
+	if err != nil {
+		return false, nil
+	}
+	var t Tombstone
+	if err := json.Unmarshal(data, &t); err != nil {
+		return false, nil
+	}
+	reason, err := s.checkTombstone(&t, string(t.Deleter), dst, rel)
+	return reason == "", err
+}
+
+// fileAuthor returns the user who may delete the file at rel in srcUser's
+// copy of a conversation: the user named by a message or metadata file's
+// name, or else srcUser.
+func fileAuthor(srcUser, rel string) upspin.UserName {
+	name := path.Base(rel)
+	if isMetaFile(upspin.PathName(name)) {
+		return metaUser(name)
+	} else if isMsgFile(upspin.PathName(name)) {
+		return MsgName(name).User()
+	}
+	return upspin.UserName(srcUser)
+}
+
+// checkTombstone returns why the tombstone t for the file at rel, found in
+// srcUser's copy, may not delete the file from the conversation at dst or ""
+// if it may.  Pruned tombstones must be signed by dst's owner.  It returns an
+// error if the tombstone couldn't be checked.
+func (s *Syncer) checkTombstone(t *Tombstone, srcUser string, dst upspin.PathName, rel string) (string, error) {
+	if s.Keys == nil {
+		return "tombstone not verified", nil
+	}
+	if t.Path != rel || t.Conversation != path.Base(string(dst)) {
+		return fmt.Sprintf("tombstone for '%v' in '%v'", t.Path, t.Conversation), nil
+	}
+	author := fileAuthor(srcUser, rel)
+	if t.Pruned {
+		author = upspin.UserName(strings.SplitN(string(dst), "/", 2)[0])
+	}
+	if t.Deleter != author {
+		return fmt.Sprintf("deleted by %v rather than %v", t.Deleter, author), nil
+	}
+	key, err := s.Keys(author)
+	if err != nil {
+		return "", &KeyLookupError{User: author, Err: err}
+	}
+	if err := t.Verify(key); err != nil {
+		return fmt.Sprintf("tombstone verification failed: %v", err), nil
+	}
+	return "", nil
+}
+
+// accepts reports whether the conflict policy allows the copy belonging to
+// srcUser to revise or delete the file at rel.
+func (s *Syncer) accepts(srcUser, rel string) bool {
+	switch s.Conflicts {
+	case ConflictTheirs:
+		return true
+	case ConflictAuthor:
+		name := path.Base(rel)
+		if isMetaFile(upspin.PathName(name)) {
+			return string(metaUser(name)) == srcUser
+		}
+		return isMsgFile(upspin.PathName(name)) && string(MsgName(name).User()) == srcUser
+	}
+	return false
+}
+
+// put writes data to p, creating its parent directories as needed.
+func (s *Syncer) put(p upspin.PathName, data []byte) error {
+	if err := MakeDirs(s.Client, upspin.PathName(path.Dir(string(p)))); err != nil {
+		return err
+	}
+	_, err := s.Client.Put(p, data)
+	return err
+}
+
+// check returns why the message at p with the given contents should be
+// quarantined from the conversation at dst or "" if it is acceptable.  It
+// returns an error if the message couldn't be checked.
+func (s *Syncer) check(p, dst upspin.PathName, data []byte) (string, error) {
+	m, err := ParseMessage(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Sprintf("malformed: %v", err), nil
+	}
+	if name := MsgName(path.Base(string(p))); name != m.Name() {
+		return fmt.Sprintf("file name differs from message name %v", m.Name()), nil
+	}
+	if title := path.Base(string(dst)); m.Title != title {
+		return fmt.Sprintf("title '%v' differs from conversation '%v'", m.Title, title), nil
+	}
+	switch err := s.Verify(m).(type) {
+	case nil, *SupersededKeyError:
+	case *KeyLookupError:
+		return "", fmt.Errorf("failed to verify %v: %v", p, err)
+	default:
+		return fmt.Sprintf("verification failed: %v", err), nil
+	}
+	return "", nil
+}
+
+// checkMeta returns why the metadata file at p with the given contents should
+// be quarantined from the conversation at dst or "" if it is acceptable.  It
+// returns an error if the metadata couldn't be checked.
+func (s *Syncer) checkMeta(p, dst upspin.PathName, data []byte) (string, error) {
+	var md Metadata
+	if err := json.Unmarshal(data, &md); err != nil {
+		return fmt.Sprintf("malformed: %v", err), nil
+	}
+	if u := metaUser(path.Base(string(p))); md.Author != u {
+		return fmt.Sprintf("file name differs from metadata author %v", md.Author), nil
+	}
+	if title := path.Base(string(dst)); md.Conversation != title {
+		return fmt.Sprintf("conversation '%v' differs from '%v'", md.Conversation, title), nil
+	}
+	key, err := s.Keys(md.Author)
+	if err != nil {
+		return "", &KeyLookupError{User: md.Author, Err: err}
+	}
+	if err := md.Verify(key); err != nil {
+		return fmt.Sprintf("verification failed: %v", err), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"upspin.io/upspin"
+)
+
+func TestSyncerQuarantine(t *testing.T) {
+	store := newMemClient()
+	alice := newTestConfig(t, "alice@example.com")
+	mallory := newTestConfig(t, "alice@example.com") // holds a different key
+	src, dst := ConvPath(alice.UserName(), "plans"), ConvPath("bob@example.com", "plans")
+
+	good := NewMessage(alice.UserName(), "plans", "", bytes.NewBufferString("hi bob"))
+	if err := good.send(store, alice, DefaultRoot(alice.UserName())); err != nil {
+		t.Fatal(err)
+	}
+	forged := NewMessage(alice.UserName(), "plans", good.Name(), bytes.NewBufferString("send money"))
+	if err := forged.send(store, mallory, DefaultRoot(alice.UserName())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Put(Join(src, "notes.pdf"), []byte("%PDF")); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Syncer{
+		Client:      store,
+		Verify:      func(m *Message) error { return m.verifyKey(alice.f.PublicKey()) },
+		Attachments: AttachQuarantine,
+	}
+	r, err := s.Sync(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := Join(dst, string(good.Name())); len(r.Copied) != 1 || r.Copied[0] != want {
+		t.Errorf("want only %v copied, got %v", want, r.Copied)
+	}
+	quarantined := map[upspin.PathName]bool{}
+	for _, q := range r.Quarantined {
+		quarantined[q.Src] = true
+	}
+	for _, p := range []upspin.PathName{Join(src, string(forged.Name())), Join(src, "notes.pdf")} {
+		if !quarantined[p] {
+			t.Errorf("%v not quarantined: %+v", p, r.Quarantined)
+		}
+	}
+	if _, err := store.Lookup(Join(dst, quarantineDir, "alice@example.com", string(forged.Name())), false); err != nil {
+		t.Errorf("forged message missing from quarantine: %v", err)
+	}
+
+	// nothing new on a second pass, and quarantined files aren't listed
+	r, err = s.Sync(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(r.Copied)+len(r.Quarantined) != 0 {
+		t.Errorf("second sync not empty: %+v", r)
+	}
+	if files, _ := recursiveList(store, dst); len(files) != 1 {
+		t.Errorf("want 1 visible file in destination, got %v", len(files))
+	}
+}
+
+func TestSyncerCheck(t *testing.T) {
+	store := newMemClient()
+	alice := newTestConfig(t, "alice@example.com")
+	src, dst := ConvPath(alice.UserName(), "plans"), ConvPath("bob@example.com", "plans")
+
+	m := NewMessage(alice.UserName(), "plans", "", bytes.NewBufferString("hi bob"))
+	if err := m.send(store, alice, DefaultRoot(alice.UserName())); err != nil {
+		t.Fatal(err)
+	}
+	other := NewMessage(alice.UserName(), "secrets", m.Name(), bytes.NewBufferString("copied"))
+	if err := other.send(store, alice, DefaultRoot(alice.UserName())); err != nil {
+		t.Fatal(err)
+	}
+	// Move the other conversation's message into this one.
+	data, _ := store.Get(Join(ConvPath(alice.UserName(), "secrets"), string(other.Name())))
+	if _, err := store.Put(Join(src, string(other.Name())), data); err != nil {
+		t.Fatal(err)
+	}
+
+	// A key server failure is retried rather than quarantined.
+	s := &Syncer{Client: store, Verify: func(m *Message) error {
+		return &KeyLookupError{User: m.Author, Err: errors.New("network down")}
+	}}
+	if r, err := s.Sync(src, dst); err == nil || len(r.Quarantined) != 0 {
+		t.Fatalf("sync with failing key server returned %+v, %v", r, err)
+	}
+
+	s.Verify = func(m *Message) error { return m.verifyKey(alice.f.PublicKey()) }
+	r, err := s.Sync(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Copied) != 1 || len(r.Quarantined) != 1 || r.Quarantined[0].Src != Join(src, string(other.Name())) {
+		t.Errorf("want message copied and other conversation's message quarantined, got %+v", r)
+	}
+}
+
+func TestSyncerMetadata(t *testing.T) {
+	store := newMemClient()
+	alice := newTestConfig(t, "alice@example.com")
+	bob := newTestConfig(t, "bob@example.com")
+	src, dst := ConvPath(alice.UserName(), "plans"), ConvPath(bob.UserName(), "plans")
+	pubkeys := TrustedKeys{alice.UserName(): alice.f.PublicKey(), bob.UserName(): bob.f.PublicKey()}
+
+	first := NewMessage(alice.UserName(), "plans", "", bytes.NewBufferString("hi bob"))
+	if err := first.send(store, alice, DefaultRoot(alice.UserName())); err != nil {
+		t.Fatal(err)
+	}
+	md := &Metadata{Description: "weekend", Creator: alice.UserName(), Created: time.Now()}
+	if err := WriteMetadata(store, alice, "plans", md, DefaultRoot(alice.UserName())); err != nil {
+		t.Fatal(err)
+	}
+	// metadata bob signed for another conversation, planted in alice's copy
+	other := &Metadata{Description: "elsewhere", Creator: bob.UserName(), Created: time.Now()}
+	if err := WriteMetadata(store, bob, "secrets", other, DefaultRoot(alice.UserName())); err != nil {
+		t.Fatal(err)
+	}
+	if err := Copy(store, Join(ConvPath(alice.UserName(), "secrets"), metaName(bob.UserName())), Join(src, metaName(bob.UserName()))); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Syncer{Client: store, Verify: pubkeys.Verify, Keys: pubkeys.Key}
+	r, err := s.Sync(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := Join(dst, metaName(alice.UserName())); len(r.Copied) != 2 || r.Copied[0] != want {
+		t.Errorf("want %v copied with the first message, got %+v", want, r)
+	}
+	if len(r.Quarantined) != 1 || r.Quarantined[0].Src != Join(src, metaName(bob.UserName())) {
+		t.Errorf("other conversation's metadata not quarantined: %+v", r.Quarantined)
+	}
+	if got, err := ReadMetadata(store, dst, pubkeys.Key); err != nil || got == nil || got.Description != "weekend" {
+		t.Errorf("synchronized metadata reads as %+v, %v", got, err)
+	}
+}
+
+// countingClient counts Lookup and Glob calls.
+type countingClient struct {
+	*memClient
+	calls int
+}
+
+func (c *countingClient) Lookup(p upspin.PathName, followFinal bool) (*upspin.DirEntry, error) {
+	c.calls++
+	return c.memClient.Lookup(p, followFinal)
+}
+
+func (c *countingClient) Glob(pattern string) ([]*upspin.DirEntry, error) {
+	c.calls++
+	return c.memClient.Glob(pattern)
+}
+
+func TestSyncerIncremental(t *testing.T) {
+	store := &countingClient{memClient: newMemClient()}
+	alice := newTestConfig(t, "alice@example.com")
+	src, dst := ConvPath(alice.UserName(), "plans"), ConvPath("bob@example.com", "plans")
+
+	post := func(parent MsgName) *Message {
+		m := NewMessage(alice.UserName(), "plans", parent, bytes.NewBufferString("hi"))
+		if err := m.send(store, alice, DefaultRoot(alice.UserName())); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	m1 := post("")
+
+	s := &Syncer{Client: store, Cursors: map[upspin.PathName]*Cursor{}}
+	if r, err := s.Sync(src, dst); err != nil {
+		t.Fatal(err)
+	} else if len(r.Copied) != 1 {
+		t.Fatalf("want 1 file copied, got %v", r.Copied)
+	}
+
+	// an unchanged source directory costs a single lookup
+	store.calls = 0
+	if r, err := s.Sync(src, dst); err != nil {
+		t.Fatal(err)
+	} else if len(r.Copied) != 0 || store.calls != 1 {
+		t.Errorf("unchanged sync copied %v with %v calls", r.Copied, store.calls)
+	}
+
+	// only the new file is examined at the destination
+	post(m1.Name())
+	if r, err := s.Sync(src, dst); err != nil {
+		t.Fatal(err)
+	} else if len(r.Copied) != 1 {
+		t.Errorf("want 1 new file copied, got %v", r.Copied)
+	}
+
+	// a full sync re-examines everything but finds nothing new
+	if err := store.Delete(Join(dst, string(m1.Name()))); err != nil {
+		t.Fatal(err)
+	}
+	s.Full = true
+	if r, err := s.Sync(src, dst); err != nil {
+		t.Fatal(err)
+	} else if len(r.Copied) != 1 || r.Copied[0] != Join(dst, string(m1.Name())) {
+		t.Errorf("full sync didn't restore deleted file: %v", r.Copied)
+	}
+}
+
+func TestSyncerRevisionsAndDeletions(t *testing.T) {
+	store := newMemClient()
+	alice := newTestConfig(t, "alice@example.com")
+	bob := newTestConfig(t, "bob@example.com")
+	asrc, bsrc := ConvPath(alice.UserName(), "plans"), ConvPath(bob.UserName(), "plans")
+	dst := ConvPath("carol@example.com", "plans")
+
+	post := func(c *testConfig, parent MsgName, text string) *Message {
+		m := NewMessage(c.UserName(), "plans", parent, bytes.NewBufferString(text))
+		if err := m.send(store, c, DefaultRoot(c.UserName())); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	m1 := post(alice, "", "meet at 3")
+	if err := Copy(store, Join(asrc, string(m1.Name())), Join(bsrc, string(m1.Name()))); err != nil {
+		t.Fatal(err)
+	}
+
+	pubkeys := TrustedKeys{alice.UserName(): alice.f.PublicKey(), bob.UserName(): bob.f.PublicKey()}
+	s := &Syncer{Client: store, Keys: func(u upspin.UserName) (upspin.PublicKey, error) { return pubkeys[u], nil }}
+	if _, err := s.Sync(asrc, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	// alice's revision of her own message is accepted, bob's isn't
+	post(alice, "", "meet at 4")
+	if _, err := store.Put(Join(bsrc, string(m1.Name())), []byte("meet at 5")); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.Sync(asrc, dst)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(r.Updated) != 1 {
+		t.Errorf("alice's revision not applied: %+v", r)
+	}
+	r, err = s.Sync(bsrc, dst)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(r.Updated) != 0 || len(r.Quarantined) != 1 {
+		t.Errorf("bob's revision not quarantined: %+v", r)
+	}
+	if data, _ := store.Get(Join(dst, string(m1.Name()))); !bytes.Contains(data, []byte("meet at 4")) {
+		t.Errorf("destination doesn't hold alice's revision:\n%s", data)
+	}
+
+	// tombstones planted in alice's copy by bob are rejected
+	for _, deleter := range []upspin.UserName{bob.UserName(), alice.UserName()} {
+		ts := &Tombstone{Conversation: "plans", Path: string(m1.Name()), Deleter: deleter, Time: time.Now()}
+		if err := putTombstone(store, bob, asrc, ts); err != nil {
+			t.Fatal(err)
+		}
+		r, err = s.Sync(asrc, dst)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(r.Deleted) != 0 || len(r.Quarantined) != 1 {
+			t.Errorf("bob's tombstone as %v not quarantined: %+v", deleter, r)
+		}
+		if err := store.Delete(Join(dst, quarantineDir, string(alice.UserName()), tombstoneDir, string(m1.Name()))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// alice's deletion propagates and isn't undone by bob's stale copy
+	if err := Remove(store, alice, asrc, string(m1.Name())); err != nil {
+		t.Fatal(err)
+	}
+	r, err = s.Sync(asrc, dst)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(r.Deleted) != 1 {
+		t.Errorf("alice's deletion not applied: %+v", r)
+	}
+	if _, err := s.Sync(bsrc, dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Lookup(Join(dst, string(m1.Name())), false); err == nil {
+		t.Errorf("deleted message restored from a stale copy")
+	}
+}
@@ -1,14 +1,17 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
 	"path"
+	"path/filepath"
 	"strings"
 
 	"upspin.io/access"
 	"upspin.io/bind"
-	upath "upspin.io/path"
 	"upspin.io/upspin"
 )
 
@@ -37,6 +40,8 @@ func MakeDirs(cl upspin.Client, p upspin.PathName) error {
 	return nil
 }
 
+// recursiveList returns all files below p except Access files and hidden
+// (dot-prefixed) files and directories.
 func recursiveList(cl upspin.Client, p upspin.PathName) ([]*upspin.DirEntry, error) {
 	ents, err := cl.Glob(string(Join(p, "*")))
 	if err != nil {
@@ -45,7 +50,7 @@ func recursiveList(cl upspin.Client, p upspin.PathName) ([]*upspin.DirEntry, err
 
 	files := []*upspin.DirEntry{}
 	for _, ent := range ents {
-		if path.Base(string(ent.SignedName)) == "Access" {
+		if base := path.Base(string(ent.SignedName)); base == "Access" || strings.HasPrefix(base, ".") {
 			continue
 		}
 
@@ -100,36 +105,6 @@ func Copy(cl upspin.Client, src, dst upspin.PathName) (err error) {
 	return err
 }
 
-func Synchronize(cl upspin.Client, src, dst upspin.PathName) error {
-	srcs, err := recursiveList(cl, src)
-	if err != nil {
-		return fmt.Errorf("failed to retrieve src files: %v", err)
-	}
-
-	pdst, err := upath.Parse(dst)
-	if err != nil {
-		return err
-	}
-
-	for _, ent := range srcs {
-		p, err := upath.Parse(ent.SignedName)
-		if err != nil {
-			return err
-		}
-		srcpath := ent.SignedName
-		dstpath := Join(upspin.PathName(pdst.User()), p.FilePath())
-		_, err = cl.Lookup(dstpath, false)
-		if err == nil {
-			continue // file exists at destination already
-		}
-		err = Copy(cl, srcpath, dstpath)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
 func AddFile(cl upspin.Client, fpath upspin.PathName, r io.Reader) (err error) {
 	f, err := cl.Create(fpath)
 	if err != nil {
@@ -160,6 +135,40 @@ func readAccess(cl upspin.Client, dir upspin.PathName) (*access.Access, error) {
 	return access.Parse(pth, data)
 }
 
+// groupMembers returns the users in the upspin Group file at group,
+// expanding nested groups.  The group is evaluated as if referenced from an
+// Access file in dir.
+func groupMembers(cl upspin.Client, dir, group upspin.PathName) ([]upspin.UserName, error) {
+	if !access.IsGroupFile(group) {
+		return nil, fmt.Errorf("%v is not a Group file", group)
+	}
+	ac, err := access.Parse(Join(dir, "Access"), []byte(fmt.Sprintf("read: %v", group)))
+	if err != nil {
+		return nil, err
+	}
+	return ac.Users(access.Read, func(p upspin.PathName) ([]byte, error) { return cl.Get(p) })
+}
+
+// accessMentions reports whether the Access file contents in data name who
+// (a user or group) in any rule.
+func accessMentions(data []byte, who string) bool {
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		for _, name := range strings.FieldsFunc(line[i+1:], func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+			if name == who {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // lookup returns the public key for a given upspin user using the key server
 // endpoint contained in the given upspin config.
 func lookup(config upspin.Config, name upspin.UserName) (key upspin.PublicKey, err error) {
@@ -173,3 +182,88 @@ func lookup(config upspin.Config, name upspin.UserName) (key upspin.PublicKey, e
 	}
 	return user.PublicKey, nil
 }
+
+// loadJSON decodes the JSON contents of the local file fname into v.  A
+// missing file is not an error and leaves v untouched.
+func loadJSON(fname string, v interface{}) error {
+	data, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// saveJSON atomically replaces the local file fname with the JSON encoding of
+// v, creating parent directories as needed.
+func saveJSON(fname string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
+		return err
+	}
+	tmp := fname + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fname)
+}
+
+// RemoveAll deletes everything beneath the directory p and, unless
+// keepAccess is true, p's Access file and p itself.  Access files of
+// subdirectories are always deleted.
+func RemoveAll(cl upspin.Client, p upspin.PathName, keepAccess bool) error {
+	ents, err := cl.Glob(string(Join(p, "*")))
+	if err != nil {
+		return err
+	}
+	for _, ent := range ents {
+		if ent.IsDir() {
+			err = RemoveAll(cl, ent.SignedName, false)
+		} else if keepAccess && path.Base(string(ent.SignedName)) == "Access" {
+			continue
+		} else {
+			err = cl.Delete(ent.SignedName)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to delete %v: %v", ent.SignedName, err)
+		}
+	}
+	if keepAccess {
+		return nil
+	}
+	return cl.Delete(p)
+}
+
+// RevokeAccess rewrites the Access file in dir to drop the grants to every
+// user and group except owner, leaving owner's rules in place.
+func RevokeAccess(cl upspin.Client, dir upspin.PathName, owner upspin.UserName) error {
+	pth := Join(dir, "Access")
+	data, err := cl.Get(pth)
+	if err != nil {
+		return nil // nobody has been granted access
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			lines = append(lines, line)
+			continue
+		}
+		var kept []string
+		for _, w := range splitList(line[i+1:]) {
+			if upspin.UserName(w) == owner {
+				kept = append(kept, w)
+			}
+		}
+		if len(kept) > 0 {
+			lines = append(lines, fmt.Sprintf("%v: %v", strings.TrimSpace(line[:i]), strings.Join(kept, ", ")))
+		}
+	}
+	_, err = cl.Put(pth, []byte(strings.Join(lines, "\n")))
+	return err
+}